@@ -0,0 +1,115 @@
+package vaar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// NewAppendComposer creates a Composer appending to the uncompressed tarball in rws, like "tar -r".
+// The headers are read from the beginning to find the end of the last entry, and the trailing zero blocks
+// are overwritten by the new entries. An empty rws is a new tarball.
+// With WithUpdate, files not newer than the ones with the same names in the tarball are skipped, like "tar -u".
+// Compression and WithIndex are not supported.
+func NewAppendComposer(rws io.ReadWriteSeeker, options ...Option) (*Composer, error) {
+	c, err := newComposer(options)
+	if err != nil {
+		return nil, err
+	}
+	if c.algorithm != NoAlgorithm {
+		return nil, errors.New("compressed tarballs cannot be appended")
+	}
+	if c.index != nil {
+		return nil, errors.New("appended tarballs cannot be indexed")
+	}
+	if _, err := rws.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to the beginning of the tarball: %w", err)
+	}
+	end, archived, err := scanTarball(rws)
+	if err != nil {
+		return nil, err
+	}
+	if c.update {
+		c.archived = archived
+	}
+	if _, err := rws.Seek(end, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to the end of the tarball: %w", err)
+	}
+	if err := c.init(rws); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// scanTarball reads the headers of a tarball, and returns the offset right after the last entry,
+// with the latest modification times of the entries by their cleaned names.
+func scanTarball(rs io.ReadSeeker) (int64, map[string]time.Time, error) {
+	r := &offsetReader{r: rs}
+	tr := tar.NewReader(r)
+	archived := make(map[string]time.Time)
+	var end int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return end, archived, nil
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read from tar stream: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg && !isSparse(header) {
+			// The content is skipped by seeking in the next call.
+			end = r.offset + header.Size
+		} else {
+			// The size in the tarball is unknown for sparse files. Read through to find it.
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return 0, nil, fmt.Errorf("failed to read %s from tar stream: %w", header.Name, err)
+			}
+			end = r.offset
+		}
+		end += blockPadding(end)
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := path.Clean(strings.TrimLeft(header.Name, "/"))
+		if header.ModTime.After(archived[name]) {
+			archived[name] = header.ModTime
+		}
+	}
+}
+
+// offsetReader tracks the offset of a ReadSeeker, which tar.Reader seeks to skip the contents.
+type offsetReader struct {
+	r      io.ReadSeeker
+	offset int64
+}
+
+func (r *offsetReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.r.Seek(offset, whence)
+	if err == nil {
+		r.offset = n
+	}
+	return n, err
+}
+
+// newer reports whether the header is newer than the entry with the same name in the tarball appended in update mode.
+// The times are compared by seconds if the archived one has no sub-second precision.
+func (c *Composer) newer(header *tar.Header) bool {
+	archived, ok := c.archived[path.Clean(header.Name)]
+	if !ok {
+		return true
+	}
+	if archived.Nanosecond() == 0 {
+		return header.ModTime.Unix() > archived.Unix()
+	}
+	return header.ModTime.After(archived)
+}
@@ -0,0 +1,63 @@
+package vaar
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// errSymlinkComponent is returned when a path beneath a directory goes through a symlink or leaves the directory.
+var errSymlinkComponent = errors.New("path goes through a symlink or out of the directory")
+
+// walkBeneath opens the directory with the relative name in rootFd component by component,
+// without following any symlinks. If create is true, missing directories are created.
+func walkBeneath(rootFd int, name string, create bool) (int, error) {
+	fd, err := unix.Openat(rootFd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			_ = unix.Close(fd)
+			return -1, errSymlinkComponent
+		}
+		next, err := openDirNoFollow(fd, component)
+		if errors.Is(err, unix.ENOENT) && create {
+			// The directory may be created by another worker at the same time.
+			if err = unix.Mkdirat(fd, component, 0o777); err == nil || errors.Is(err, unix.EEXIST) {
+				next, err = openDirNoFollow(fd, component)
+			}
+		}
+		_ = unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// openDirNoFollow opens the directory with the name in dirFd. If it's a symlink, errSymlinkComponent is returned.
+func openDirNoFollow(dirFd int, name string) (int, error) {
+	fd, err := unix.Openat(dirFd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) {
+		var stat unix.Stat_t
+		if unix.Fstatat(dirFd, name, &stat, unix.AT_SYMLINK_NOFOLLOW) == nil && stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return -1, errSymlinkComponent
+		}
+	}
+	return fd, err
+}
+
+// unlinkat removes the file or the empty directory with the name in dirFd, like os.Remove.
+func unlinkat(dirFd int, name string) error {
+	err := unix.Unlinkat(dirFd, name, 0)
+	if err == nil || unix.Unlinkat(dirFd, name, unix.AT_REMOVEDIR) == nil {
+		return nil
+	}
+	return err
+}
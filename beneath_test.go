@@ -0,0 +1,40 @@
+package vaar
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func Test_walkBeneath(t *testing.T) {
+	outsideDir := fs.NewDir(t, "outside")
+	tmpDir := fs.NewDir(
+		t, "test",
+		fs.WithDir("a"),
+		fs.WithSymlink("b", outsideDir.Path()),
+		fs.WithSymlink("c", "a"),
+	)
+	rootFd, err := unix.Open(tmpDir.Path(), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	assert.NilError(t, err)
+	defer func() { _ = unix.Close(rootFd) }()
+	for _, open := range []func(int, string, bool) (int, error){walkBeneath, openBeneath} {
+		fd, err := open(rootFd, "a/d/e", true)
+		assert.NilError(t, err)
+		assert.NilError(t, unix.Close(fd))
+		_, err = os.Stat(tmpDir.Join("a", "d", "e"))
+		assert.NilError(t, err)
+		_, err = open(rootFd, "a/f", false)
+		assert.ErrorIs(t, err, unix.ENOENT)
+		_, err = open(rootFd, "b/d", true)
+		assert.ErrorIs(t, err, errSymlinkComponent)
+		_, err = open(rootFd, "c", false)
+		assert.ErrorIs(t, err, errSymlinkComponent)
+		_, err = open(rootFd, "a/../..", false)
+		assert.ErrorIs(t, err, errSymlinkComponent)
+	}
+	_, err = os.Stat(outsideDir.Join("d"))
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,137 @@
+package vaar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// paxChecksumPrefix is the prefix of the PAX records of checksums, followed by the name of the Checksum,
+// like VAAR.sha256. The value is the hex digest of the file content.
+const paxChecksumPrefix = "VAAR."
+
+// newHash creates a hash of the checksum algorithm, which mustn't be NoChecksum.
+func (c Checksum) newHash() hash.Hash {
+	switch c {
+	case SHA256Checksum:
+		return sha256.New()
+	case BLAKE3Checksum:
+		return blake3.New()
+	default:
+		return xxh3.New()
+	}
+}
+
+// paxKey returns the PAX record of the checksum algorithm.
+func (c Checksum) paxKey() string {
+	return paxChecksumPrefix + c.String()
+}
+
+// writeChecksummedFile writes a regular file with the digest of its content recorded in the header.
+// The digest must precede the content, so a file fitting in the buffer is read into it once, and then written.
+// Otherwise, r must be an io.ReadSeeker, and the file is read twice: it's hashed before the header is written,
+// and hashed again while being copied, so that it fails instead of storing a wrong digest if it changes in between.
+func (c *Composer) writeChecksummedFile(ctx context.Context, header *tar.Header, r io.Reader) (int64, error) {
+	if header.Size <= int64(len(c.buf)) {
+		buf := c.buf[:header.Size]
+		if _, err := io.ReadFull(newContextReader(ctx, r), buf); err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		h := c.checksum.newHash()
+		_, _ = h.Write(buf)
+		if err := c.writeChecksumHeader(header, h.Sum(nil)); err != nil {
+			return 0, err
+		}
+		n, err := c.tw.Write(buf)
+		if err != nil {
+			return int64(n), fmt.Errorf("failed to write body for %s: %w", header.Name, err)
+		}
+		return int64(n), nil
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return 0, fmt.Errorf("failed to checksum %s: content too big to be buffered is not seekable", header.Name)
+	}
+	h := c.checksum.newHash()
+	if err := c.copyFile(ctx, header, h, rs); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", header.Name, err)
+	}
+	sum := h.Sum(nil)
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek back in %s: %w", header.Name, err)
+	}
+	if err := c.writeChecksumHeader(header, sum); err != nil {
+		return 0, err
+	}
+	h.Reset()
+	if err := c.copyFile(ctx, header, io.MultiWriter(c.tw, h), rs); err != nil {
+		return 0, fmt.Errorf("failed to write body for %s: %w", header.Name, err)
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return header.Size, fmt.Errorf("failed to write body for %s: file changed when reading", header.Name)
+	}
+	return header.Size, nil
+}
+
+// copyFile copies exactly the size of the file in the header from r to w.
+func (c *Composer) copyFile(ctx context.Context, header *tar.Header, w io.Writer, r io.Reader) error {
+	n, err := io.CopyBuffer(w, newContextReader(ctx, io.LimitReader(r, header.Size)), c.buf)
+	if err == nil && n < header.Size {
+		err = fmt.Errorf("file shrank when reading: %w", io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// writeChecksumHeader records the digest in the header, and writes the header.
+func (c *Composer) writeChecksumHeader(header *tar.Header, sum []byte) error {
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[c.checksum.paxKey()] = hex.EncodeToString(sum)
+	if err := c.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header for %s: %w", header.Name, err)
+	}
+	return nil
+}
+
+// checksumReader hashes the content read from a file being extracted, to be verified in the end.
+type checksumReader struct {
+	r        io.Reader
+	h        hash.Hash
+	checksum Checksum
+	expected string
+}
+
+// newChecksumReader returns a checksumReader if the header has the checksum to verify, or nil.
+func newChecksumReader(header *tar.Header, r io.Reader, checksum Checksum) *checksumReader {
+	if checksum == NoChecksum {
+		return nil
+	}
+	expected, ok := header.PAXRecords[checksum.paxKey()]
+	if !ok {
+		return nil
+	}
+	return &checksumReader{r: r, h: checksum.newHash(), checksum: checksum, expected: expected}
+}
+
+func (r *checksumReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	_, _ = r.h.Write(b[:n])
+	return n, err
+}
+
+// verify returns a ChecksumError if the content read doesn't match the checksum.
+func (r *checksumReader) verify(name string) error {
+	if actual := hex.EncodeToString(r.h.Sum(nil)); actual != r.expected {
+		return &ChecksumError{Name: name, Checksum: r.checksum, Expected: r.expected, Actual: actual}
+	}
+	return nil
+}
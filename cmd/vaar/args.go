@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/user"
+	"strconv"
 	"strings"
 
 	"github.com/moycat/vaar"
@@ -18,16 +20,41 @@ func (arg *algorithmArg) String() string {
 }
 
 func (arg *algorithmArg) Set(s string) error {
-	switch strings.ToLower(s) {
-	case "":
-		arg.value = vaar.NoAlgorithm
-	case "gzip":
-		arg.value = vaar.GzipAlgorithm
-	case "lz4":
-		arg.value = vaar.LZ4Algorithm
-	default:
+	algorithm, err := vaar.ParseAlgorithm(s)
+	if err != nil {
 		return fmt.Errorf("unknown algorithm '%s'", s)
 	}
+	arg.value = algorithm
+	return nil
+}
+
+// algorithmUsage describes the registered algorithms, and which are only supported in extraction.
+func algorithmUsage() string {
+	var compressible, extractOnly []string
+	for _, algorithm := range vaar.Algorithms() {
+		if algorithm.CanCompress() {
+			compressible = append(compressible, algorithm.String())
+		} else {
+			extractOnly = append(extractOnly, algorithm.String())
+		}
+	}
+	extractOnly = append(extractOnly, vaar.AutoAlgorithm.String())
+	return fmt.Sprintf(
+		"optional, compression algorithm (%s; %s for extraction and listing, auto by default)",
+		strings.Join(compressible, ", "), strings.Join(extractOnly, " or "),
+	)
+}
+
+type stringsArg struct {
+	values []string
+}
+
+func (arg *stringsArg) String() string {
+	return strings.Join(arg.values, ",")
+}
+
+func (arg *stringsArg) Set(s string) error {
+	arg.values = append(arg.values, s)
 	return nil
 }
 
@@ -57,22 +84,149 @@ func (arg *levelArg) Set(s string) error {
 	return nil
 }
 
+type checksumArg struct {
+	value vaar.Checksum
+}
+
+func (arg *checksumArg) String() string {
+	return arg.value.String()
+}
+
+func (arg *checksumArg) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "", "none":
+		arg.value = vaar.NoChecksum
+	case "sha256":
+		arg.value = vaar.SHA256Checksum
+	case "blake3":
+		arg.value = vaar.BLAKE3Checksum
+	case "xxh3":
+		arg.value = vaar.XXH3Checksum
+	default:
+		return fmt.Errorf("unknown checksum algorithm: '%s'", s)
+	}
+	return nil
+}
+
+// ownerArg is a user or a group, like NAME, NAME:ID or ID.
+type ownerArg struct {
+	name  string
+	id    int
+	isSet bool
+	// lookup returns the local ID of the name.
+	lookup func(name string) (string, error)
+}
+
+func (arg *ownerArg) String() string {
+	if !arg.isSet {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", arg.name, arg.id)
+}
+
+func (arg *ownerArg) Set(s string) error {
+	name, idStr := s, ""
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		name, idStr = s[:i], s[i+1:]
+	} else if _, err := strconv.Atoi(s); err == nil {
+		name, idStr = "", s
+	}
+	if idStr == "" {
+		// Only the name is given. Use the local ID.
+		var err error
+		if idStr, err = arg.lookup(name); err != nil {
+			return err
+		}
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 0 {
+		return fmt.Errorf("invalid ID '%s'", idStr)
+	}
+	arg.name, arg.id, arg.isSet = name, id, true
+	return nil
+}
+
+// idMappingsArg is a list of ID mappings, like CONTAINER_ID:HOST_ID:SIZE.
+type idMappingsArg struct {
+	values []vaar.IDMapping
+}
+
+func (arg *idMappingsArg) String() string {
+	s := make([]string, 0, len(arg.values))
+	for _, m := range arg.values {
+		s = append(s, fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size))
+	}
+	return strings.Join(s, ",")
+}
+
+func (arg *idMappingsArg) Set(s string) error {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid ID mapping '%s'", s)
+	}
+	var ids [3]int
+	for i, field := range fields {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return fmt.Errorf("invalid ID mapping '%s'", s)
+		}
+		ids[i] = id
+	}
+	arg.values = append(arg.values, vaar.IDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	return nil
+}
+
 func parseArgs() *command {
 	c := &command{
 		algorithm: algorithmArg{value: vaar.NoAlgorithm},
 		level:     levelArg{value: vaar.DefaultLevel},
+		owner: ownerArg{lookup: func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}},
+		group: ownerArg{lookup: func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}},
 	}
 	set := flag.NewFlagSet("Var", flag.ExitOnError)
-	set.Var(&c.algorithm, "c", "optional, algorithm algorithm (gzip or lz4)")
+	set.Var(&c.algorithm, "c", algorithmUsage())
 	set.Var(&c.level, "l", "[creation] optional, algorithm level (fastest, fast, default, good, best)")
-	set.StringVar(&c.extractPath, "d", ".", "[extraction] optional, target path")
-	set.IntVar(&c.thread, "t", 4, "[extraction] optional, write thread number")
+	set.StringVar(&c.extractPath, "d", ".", "[extraction/comparison] optional, target path")
+	set.IntVar(&c.thread, "t", 4, "optional, walk thread number in creation, write thread number in extraction")
+	set.IntVar(&c.strip, "strip-components", 0, "[extraction] optional, number of leading path components to strip")
 	set.IntVar(&c.threshold, "s", 512, "[extraction] optional, buffered write threshold in bytes")
 	set.IntVar(&c.readAhead, "r", 512, "optional, read ahead number")
+	set.IntVar(&c.compressionThreads, "T", 0, "optional, compression thread number, 0 for all CPUs")
+	set.BoolVar(&c.xattrs, "xattrs", false, "optional, preserve extended attributes, ACLs and file capabilities")
+	set.BoolVar(&c.sparse, "sparse", false, "[creation] optional, store holes in sparse files efficiently")
+	set.BoolVar(&c.reproducible, "reproducible", false, "[creation] optional, sort by names, zero owners and clamp times to SOURCE_DATE_EPOCH")
+	set.Var(&c.checksum, "checksum", "[creation/extraction] optional, store the checksums of files in creation and verify them in extraction (sha256, blake3, xxh3)")
+	set.StringVar(&c.snapshotPath, "listed-incremental", "", "[creation] optional, snapshot file, only archive files changed since it and update it")
+	set.StringVar(&c.indexPath, "index", "", "optional, index file, written in creation and used to extract the members only in extraction")
+	set.BoolVar(&c.incremental, "incremental", false, "[extraction] optional, delete files listed as deleted in incremental tarballs")
+	set.Var(&c.owner, "owner", "[creation] optional, record the user as the owner of all files, like NAME, NAME:UID or UID")
+	set.Var(&c.group, "group", "[creation] optional, record the group of all files, like NAME, NAME:GID or GID")
+	set.BoolVar(&c.numericOwner, "numeric-owner", false, "optional, use the uid and gid only, ignoring the user and group names")
+	set.Var(&c.uidMappings, "uid-map", "optional, map the uids between the tarball and the host, like CONTAINER_ID:HOST_ID:SIZE, can be repeated")
+	set.Var(&c.gidMappings, "gid-map", "optional, map the gids between the tarball and the host, like CONTAINER_ID:HOST_ID:SIZE, can be repeated")
+	set.BoolVar(&c.skipUnsupported, "skip-unsupported", false, "optional, skip unsupported files instead of failing")
+	set.Var(&c.excludes, "exclude", "optional, skip files matching the glob pattern, can be repeated")
+	set.StringVar(&c.excludeFrom, "exclude-from", "", "optional, skip files matching the glob patterns in the file")
+	set.Var(&c.includes, "include", "optional, only keep files matching the glob pattern, can be repeated")
+	set.BoolVar(&c.verbose, "v", false, "optional, show the progress, or list in the long format")
+	set.BoolVar(&c.verbose, "progress", false, "[creation/extraction] optional, show the progress, same as -v")
 	_ = set.Parse(os.Args[1:])
 	reportAndExit := func(errMsg string) {
-		fmt.Println(errMsg)
-		fmt.Println()
+		// Nothing but the tarball is written to stdout.
+		fmt.Fprintln(os.Stderr, errMsg)
+		fmt.Fprintln(os.Stderr)
 		set.Usage()
 		os.Exit(2)
 	}
@@ -80,7 +234,7 @@ func parseArgs() *command {
 	args := set.Args()
 	switch len(args) {
 	case 0:
-		reportAndExit("Operation is missing: c/create or x/extract")
+		reportAndExit("Operation is missing: c/create, r/append, u/update, x/extract, t/list or d/diff")
 	case 1:
 		reportAndExit("Archive file name is missing.")
 	}
@@ -92,13 +246,60 @@ func parseArgs() *command {
 		}
 		c.operation = "create"
 		c.sourcePaths = args[2:]
+	case "r", "append", "u", "update":
+		if len(args) < 3 {
+			reportAndExit("Source paths are missing for archive appending.")
+		}
+		if c.archivePath == "-" {
+			reportAndExit("Standard output cannot be appended to.")
+		}
+		c.operation = "append"
+		if op == "u" || op == "update" {
+			c.operation = "update"
+		}
+		c.sourcePaths = args[2:]
 	case "x", "extract":
-		if len(args) > 2 {
-			reportAndExit("Too many arguments for extraction.")
+		if len(args) > 2 && c.indexPath == "" {
+			reportAndExit("Members can only be extracted with an index.")
+		}
+		if c.archivePath == "-" && c.indexPath != "" {
+			reportAndExit("Standard input cannot be extracted with an index.")
 		}
 		c.operation = "extract"
+		c.members = args[2:]
+		// Detect the compression algorithm, unless specified.
+		if !isFlagSet(set, "c") {
+			c.algorithm.value = vaar.AutoAlgorithm
+		}
+	case "t", "list":
+		if len(args) > 2 {
+			reportAndExit("Too many arguments for listing.")
+		}
+		c.operation = "list"
+		if !isFlagSet(set, "c") {
+			c.algorithm.value = vaar.AutoAlgorithm
+		}
+	case "d", "diff":
+		if len(args) > 2 {
+			reportAndExit("Too many arguments for comparison.")
+		}
+		c.operation = "diff"
+		if !isFlagSet(set, "c") {
+			c.algorithm.value = vaar.AutoAlgorithm
+		}
 	default:
-		reportAndExit(fmt.Sprintf("Unknown operation %s\nSupported operations: c/create or x/extract", op))
+		reportAndExit(fmt.Sprintf("Unknown operation %s\nSupported operations: c/create, r/append, u/update, x/extract, t/list or d/diff", op))
 	}
 	return c
 }
+
+// isFlagSet reports whether a flag is set in the command line.
+func isFlagSet(set *flag.FlagSet, name string) bool {
+	found := false
+	set.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
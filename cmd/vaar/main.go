@@ -1,10 +1,15 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/moycat/vaar"
 )
@@ -14,19 +19,95 @@ type command struct {
 	archivePath string
 	extractPath string
 	sourcePaths []string
+	members     []string // Paths in the archive to extract with the index.
+	indexPath   string
+	strip       int
+	// Skip sockets in creation, and unknown types or device files without permission in extraction.
+	skipUnsupported bool
+	xattrs          bool
+	sparse          bool
+	reproducible    bool
+	checksum        checksumArg
+	// Incremental options.
+	snapshotPath string
+	incremental  bool
+	// Ownership options.
+	owner        ownerArg
+	group        ownerArg
+	numericOwner bool
+	uidMappings  idMappingsArg
+	gidMappings  idMappingsArg
 	// Compression options.
-	algorithm algorithmArg
-	level     levelArg
+	algorithm          algorithmArg
+	level              levelArg
+	compressionThreads int
 	// Parallel options.
 	thread    int
 	readAhead int
 	threshold int
+	// Filter options.
+	excludes    stringsArg
+	excludeFrom string
+	includes    stringsArg
+	// Output options.
+	verbose bool
+}
+
+// filterOptions returns the options about which files to skip.
+func (cmd *command) filterOptions() []vaar.Option {
+	var ops []vaar.Option
+	if cmd.skipUnsupported {
+		ops = append(ops, vaar.WithSkipUnsupported())
+	}
+	return append(ops, cmd.patternOptions()...)
+}
+
+// ownerOptions returns the options about how the owners are recorded and restored.
+func (cmd *command) ownerOptions() []vaar.Option {
+	var ops []vaar.Option
+	if cmd.numericOwner {
+		ops = append(ops, vaar.WithNumericOwner())
+	}
+	if len(cmd.uidMappings.values) > 0 {
+		ops = append(ops, vaar.WithUIDMappings(cmd.uidMappings.values...))
+	}
+	if len(cmd.gidMappings.values) > 0 {
+		ops = append(ops, vaar.WithGIDMappings(cmd.gidMappings.values...))
+	}
+	return ops
+}
+
+// patternOptions returns the options about which files to skip by their paths.
+func (cmd *command) patternOptions() []vaar.Option {
+	var ops []vaar.Option
+	if len(cmd.excludes.values) > 0 {
+		ops = append(ops, vaar.WithExclude(cmd.excludes.values...))
+	}
+	if cmd.excludeFrom != "" {
+		ops = append(ops, vaar.WithExcludeFrom(cmd.excludeFrom))
+	}
+	if len(cmd.includes.values) > 0 {
+		ops = append(ops, vaar.WithInclude(cmd.includes.values...))
+	}
+	return ops
 }
 
 func create(cmd *command) {
-	log.Println("creating archive", cmd.archivePath, "from", cmd.sourcePaths)
-	log.Printf("algorithm: %v, level: %v, read ahead: %d\n", cmd.algorithm.value, cmd.level.value, cmd.readAhead)
-	f, err := os.OpenFile(cmd.archivePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch cmd.operation {
+	case "append":
+		log.Println("appending", cmd.sourcePaths, "to archive", cmd.archivePath)
+	case "update":
+		log.Println("updating archive", cmd.archivePath, "from", cmd.sourcePaths)
+	default:
+		log.Println("creating archive", cmd.archivePath, "from", cmd.sourcePaths)
+	}
+	if cmd.operation != "create" {
+		// The existing tarball is read to find its end.
+		flag = os.O_CREATE | os.O_RDWR
+	}
+	log.Printf("algorithm: %v, level: %v, thread: %d, read ahead: %d\n", cmd.algorithm.value, cmd.level.value, cmd.thread, cmd.readAhead)
+	f, err := createArchive(cmd.archivePath, flag)
 	if err != nil {
 		log.Fatalln("failed to create archive file:", err)
 	}
@@ -38,15 +119,73 @@ func create(cmd *command) {
 	ops := []vaar.Option{
 		vaar.WithCompression(cmd.algorithm.value),
 		vaar.WithLevel(cmd.level.value),
+		vaar.WithThread(cmd.thread),
 		vaar.WithReadAhead(cmd.readAhead),
+		vaar.WithCompressionThreads(cmd.compressionThreads),
+	}
+	if cmd.xattrs {
+		ops = append(ops, vaar.WithXattrs())
+	}
+	if cmd.sparse {
+		ops = append(ops, vaar.WithSparse())
+	}
+	if cmd.checksum.value != vaar.NoChecksum {
+		ops = append(ops, vaar.WithChecksums(cmd.checksum.value))
+	}
+	if cmd.reproducible {
+		ops = append(ops, vaar.WithReproducible())
+	}
+	if cmd.owner.isSet {
+		ops = append(ops, vaar.WithOwner(cmd.owner.name, cmd.owner.id))
+	}
+	if cmd.group.isSet {
+		ops = append(ops, vaar.WithGroup(cmd.group.name, cmd.group.id))
+	}
+	ops = append(ops, cmd.ownerOptions()...)
+	ops = append(ops, cmd.filterOptions()...)
+	if cmd.verbose {
+		// The total size is unknown before walking.
+		progress := vaar.NewProgress(0)
+		ops = append(ops, vaar.WithCallback(progress.Callback))
+		defer reportProgress(progress)()
+	}
+	if cmd.indexPath != "" {
+		indexFile, err := os.OpenFile(cmd.indexPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			log.Fatalln("failed to create index file:", err)
+		}
+		defer func() {
+			if err := indexFile.Close(); err != nil {
+				log.Println("failed to close index file:", err)
+			}
+		}()
+		ops = append(ops, vaar.WithIndex(indexFile))
+	}
+	var snapshot *vaar.Snapshot
+	if cmd.snapshotPath != "" {
+		snapshot = loadSnapshot(cmd.snapshotPath)
+		ops = append(ops, vaar.WithSnapshot(snapshot))
+	}
+	var c *vaar.Composer
+	switch cmd.operation {
+	case "append":
+		c, err = vaar.NewAppendComposer(f, ops...)
+	case "update":
+		c, err = vaar.NewAppendComposer(f, append(ops, vaar.WithUpdate())...)
+	default:
+		c, err = vaar.NewComposer(f, ops...)
 	}
-	c, err := vaar.NewComposer(f, ops...)
 	if err != nil {
 		log.Fatalln("failed to create composer:", err)
 	}
 	defer func() {
 		if err := c.Close(); err != nil {
 			log.Println("failed to close composer:", err)
+			return
+		}
+		// The snapshot is saved only if the tarball is complete.
+		if snapshot != nil {
+			saveSnapshot(cmd.snapshotPath, snapshot)
 		}
 	}()
 	for _, path := range cmd.sourcePaths {
@@ -56,10 +195,65 @@ func create(cmd *command) {
 	}
 }
 
+// createArchive opens the archive file for writing, or returns stdout for "-".
+func createArchive(path string, flag int) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, flag, 0o644)
+}
+
+// openArchive opens the archive file for reading, or returns stdin for "-".
+func openArchive(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+// loadSnapshot reads the snapshot file, or creates an empty snapshot if it doesn't exist.
+func loadSnapshot(path string) *vaar.Snapshot {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Println("snapshot", path, "doesn't exist, creating a full archive")
+		return vaar.NewSnapshot()
+	}
+	if err != nil {
+		log.Fatalln("failed to open snapshot file:", err)
+	}
+	defer func() { _ = f.Close() }()
+	snapshot, err := vaar.ReadSnapshot(f)
+	if err != nil {
+		log.Fatalln("failed to read snapshot file:", err)
+	}
+	return snapshot
+}
+
+// saveSnapshot writes the snapshot to a temporary file and renames it to the path, to keep the old one on failure.
+func saveSnapshot(path string, snapshot *vaar.Snapshot) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		log.Println("failed to create snapshot file:", err)
+		return
+	}
+	_, err = snapshot.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		log.Println("failed to save snapshot file:", err)
+	}
+}
+
 func extract(cmd *command) {
 	log.Println("extracting archive", cmd.archivePath, "to", cmd.extractPath)
 	log.Printf("algorithm: %v, thread: %d, threshold: %d, read ahead: %d\n", cmd.algorithm.value, cmd.thread, cmd.threshold, cmd.readAhead)
-	f, err := os.Open(cmd.archivePath)
+	f, err := openArchive(cmd.archivePath)
 	if err != nil {
 		log.Fatalln("failed to open archive file:", err)
 	}
@@ -72,21 +266,234 @@ func extract(cmd *command) {
 		vaar.WithCompression(cmd.algorithm.value),
 		vaar.WithThread(cmd.thread),
 		vaar.WithThreshold(int64(cmd.threshold) << 10),
+		vaar.WithStripComponents(cmd.strip),
 		vaar.WithReadAhead(cmd.readAhead),
+		vaar.WithCompressionThreads(cmd.compressionThreads),
+	}
+	if cmd.xattrs {
+		ops = append(ops, vaar.WithXattrs())
+	}
+	if cmd.incremental {
+		ops = append(ops, vaar.WithIncremental())
 	}
-	err = vaar.Resolve(f, cmd.extractPath, ops...)
+	if cmd.checksum.value != vaar.NoChecksum {
+		ops = append(ops, vaar.WithChecksums(cmd.checksum.value))
+	}
+	ops = append(ops, cmd.ownerOptions()...)
+	ops = append(ops, cmd.filterOptions()...)
+	if cmd.indexPath != "" {
+		extractMembers(cmd, f, ops)
+		return
+	}
+	var r io.Reader = f
+	if cmd.verbose {
+		var total int64
+		if stat, err := f.Stat(); err == nil && stat.Mode().IsRegular() {
+			total = stat.Size()
+		}
+		progress := vaar.NewProgress(total)
+		r = progress.Reader(f)
+		ops = append(ops, vaar.WithCallback(progress.Callback))
+		defer reportProgress(progress)()
+	}
+	err = vaar.Resolve(r, cmd.extractPath, ops...)
 	if err != nil {
 		log.Fatalln("failed to extract tarball:", err)
 	}
 }
 
+// extractMembers extracts the members from the archive file with the index, or everything if no member is given.
+func extractMembers(cmd *command, f *os.File, ops []vaar.Option) {
+	indexFile, err := os.Open(cmd.indexPath)
+	if err != nil {
+		log.Fatalln("failed to open index file:", err)
+	}
+	defer func() { _ = indexFile.Close() }()
+	archive, err := vaar.Open(f, indexFile, vaar.WithCompressionThreads(cmd.compressionThreads))
+	if err != nil {
+		log.Fatalln("failed to open tarball with index:", err)
+	}
+	members := cmd.members
+	if len(members) == 0 {
+		members = []string{"."}
+	}
+	if cmd.verbose {
+		progress := vaar.NewProgress(0)
+		ops = append(ops, vaar.WithCallback(progress.Callback))
+		defer reportProgress(progress)()
+	}
+	for _, member := range members {
+		if err := archive.Extract(member, cmd.extractPath, ops...); err != nil {
+			log.Fatalln("failed to extract", member, "from tarball:", err)
+		}
+	}
+}
+
+func diff(cmd *command) {
+	f, err := openArchive(cmd.archivePath)
+	if err != nil {
+		log.Fatalln("failed to open archive file:", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Println("failed to close archive file:", err)
+		}
+	}()
+	ops := []vaar.Option{
+		vaar.WithCompression(cmd.algorithm.value),
+		vaar.WithCompressionThreads(cmd.compressionThreads),
+	}
+	ops = append(ops, cmd.ownerOptions()...)
+	ops = append(ops, cmd.patternOptions()...)
+	w := bufio.NewWriter(os.Stdout)
+	differs := false
+	err = vaar.Diff(f, cmd.extractPath, func(d *vaar.Difference) error {
+		differs = true
+		_, err := fmt.Fprintln(w, d)
+		return err
+	}, ops...)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalln("failed to compare tarball:", err)
+	}
+	if differs {
+		// Exit with 1 like diff, so that it can be used in scripts.
+		os.Exit(1)
+	}
+}
+
+// reportProgress logs the progress periodically, until the returned function is called.
+func reportProgress(progress *vaar.Progress) func() {
+	ticker := time.NewTicker(5 * time.Second)
+	doneCh := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				log.Println("progress:", progress.Stat())
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(doneCh)
+		log.Println("finished:", progress.Stat())
+	}
+}
+
+func list(cmd *command) {
+	f, err := openArchive(cmd.archivePath)
+	if err != nil {
+		log.Fatalln("failed to open archive file:", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Println("failed to close archive file:", err)
+		}
+	}()
+	w := bufio.NewWriter(os.Stdout)
+	ops := []vaar.Option{
+		vaar.WithCompression(cmd.algorithm.value),
+		vaar.WithCompressionThreads(cmd.compressionThreads),
+	}
+	err = vaar.List(f, func(header *tar.Header) error {
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			return nil
+		}
+		if cmd.verbose {
+			_, err := fmt.Fprintln(w, formatLongHeader(header))
+			return err
+		}
+		_, err := fmt.Fprintln(w, header.Name)
+		return err
+	}, ops...)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatalln("failed to list tarball:", err)
+	}
+}
+
+// formatLongHeader formats a header like "ls -l", in the same way as GNU tar.
+func formatLongHeader(header *tar.Header) string {
+	var typ byte
+	switch header.Typeflag {
+	case tar.TypeDir:
+		typ = 'd'
+	case tar.TypeSymlink:
+		typ = 'l'
+	case tar.TypeLink:
+		typ = 'h'
+	case tar.TypeChar:
+		typ = 'c'
+	case tar.TypeBlock:
+		typ = 'b'
+	case tar.TypeFifo:
+		typ = 'p'
+	default:
+		typ = '-'
+	}
+	perm := []byte("rwxrwxrwx")
+	for i := range perm {
+		if header.Mode&(1<<(8-i)) == 0 {
+			perm[i] = '-'
+		}
+	}
+	setSpecialBit := func(i int, set bool, c byte) {
+		if !set {
+			return
+		}
+		if perm[i] == '-' {
+			c -= 'a' - 'A' // Upper case means the execution bit is absent.
+		}
+		perm[i] = c
+	}
+	setSpecialBit(2, header.Mode&04000 != 0, 's')
+	setSpecialBit(5, header.Mode&02000 != 0, 's')
+	setSpecialBit(8, header.Mode&01000 != 0, 't')
+	owner, group := header.Uname, header.Gname
+	if owner == "" {
+		owner = fmt.Sprint(header.Uid)
+	}
+	if group == "" {
+		group = fmt.Sprint(header.Gid)
+	}
+	var size string
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		size = fmt.Sprintf("%d,%d", header.Devmajor, header.Devminor)
+	default:
+		size = fmt.Sprint(header.Size)
+	}
+	line := fmt.Sprintf(
+		"%c%s %s/%s %9s %s %s",
+		typ, perm, owner, group, size, header.ModTime.Format("2006-01-02 15:04"), header.Name,
+	)
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		line += " -> " + header.Linkname
+	case tar.TypeLink:
+		line += " link to " + header.Linkname
+	}
+	return line
+}
+
 func main() {
 	cmd := parseArgs()
 	switch cmd.operation {
-	case "create":
+	case "create", "append", "update":
 		create(cmd)
 	case "extract":
 		extract(cmd)
+	case "list":
+		list(cmd)
+	case "diff":
+		diff(cmd)
 	}
 }
 
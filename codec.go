@@ -0,0 +1,294 @@
+package vaar
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// WriterFunc creates a compression writer to w with the level and the number of threads, which is at least 1.
+// Closing the writer completes the compressed stream, without closing w.
+// If the writer has a Reset(w io.Writer) method starting a new stream after being closed, it supports WithIndex.
+type WriterFunc func(w io.Writer, level Level, threads int) (io.WriteCloser, error)
+
+// ReaderFunc creates a decompression reader from r with the number of threads, which is at least 1.
+// Concatenated streams must be read as a whole. Closing the reader releases its resources, without closing r.
+type ReaderFunc func(r io.Reader, threads int) (io.ReadCloser, error)
+
+// codec is a registered compression algorithm.
+type codec struct {
+	algorithm Algorithm
+	name      string
+	magic     []byte
+	// match detects the algorithm from the leading matchSize bytes instead of magic, if not nil.
+	match     func(b []byte) bool
+	matchSize int
+	newWriter WriterFunc // Nil if only decompression is supported.
+	newReader ReaderFunc
+	// Decompress ahead of the consumer in another goroutine, if multiple threads are given explicitly.
+	readAhead bool
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    []*codec // In the order of registration, which is also the order of detection.
+	// The next value of Algorithm to be registered.
+	nextAlgorithm = AutoAlgorithm + 1
+)
+
+func init() {
+	registerCodec(&codec{
+		algorithm: GzipAlgorithm,
+		name:      "gzip",
+		magic:     []byte{0x1f, 0x8b},
+		newWriter: newGzipWriter,
+		newReader: newGzipReader,
+		readAhead: true,
+	})
+	registerCodec(&codec{
+		algorithm: LZ4Algorithm,
+		name:      "lz4",
+		magic:     []byte{0x04, 0x22, 0x4d, 0x18},
+		newWriter: newLZ4Writer,
+		newReader: newLZ4Reader,
+	})
+	registerCodec(&codec{
+		algorithm: ZstdAlgorithm,
+		name:      "zstd",
+		magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newWriter: newZstdWriter,
+		newReader: newZstdReader,
+	})
+	registerCodec(&codec{
+		algorithm: Bzip2Algorithm,
+		name:      "bzip2",
+		match:     matchBzip2,
+		matchSize: bzip2MagicSize,
+		newReader: newBzip2Reader,
+	})
+}
+
+// RegisterCodec registers a compression algorithm, and returns the Algorithm to be used with WithCompression.
+// The name is case-insensitive, as used by ParseAlgorithm. If the magic number isn't empty, the algorithm is
+// detected by AutoAlgorithm from the leading bytes of a tarball. newWriter can be nil if only decompression is supported.
+// It's meant to be called in init, and panics if the name is taken or newReader is nil.
+func RegisterCodec(name string, magic []byte, newWriter WriterFunc, newReader ReaderFunc) Algorithm {
+	return registerCodec(&codec{
+		name:      name,
+		magic:     append([]byte(nil), magic...),
+		newWriter: newWriter,
+		newReader: newReader,
+	})
+}
+
+// registerCodec registers a codec, allocating its Algorithm if it's NoAlgorithm.
+func registerCodec(c *codec) Algorithm {
+	c.name = strings.ToLower(c.name)
+	if c.name == "" || c.newReader == nil {
+		panic("vaar: invalid codec " + c.name)
+	}
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	taken := c.name == NoAlgorithm.String() || c.name == AutoAlgorithm.String()
+	for _, registered := range codecs {
+		taken = taken || registered.name == c.name
+	}
+	if taken {
+		panic("vaar: codec " + c.name + " is already registered")
+	}
+	if c.algorithm == NoAlgorithm {
+		if nextAlgorithm == NoAlgorithm {
+			panic("vaar: too many codecs")
+		}
+		c.algorithm = nextAlgorithm
+		nextAlgorithm++
+	}
+	codecs = append(codecs, c)
+	return c.algorithm
+}
+
+// ParseAlgorithm returns the algorithm by its case-insensitive name, including "none" and "auto".
+// An empty name means NoAlgorithm.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch name = strings.ToLower(name); name {
+	case "", NoAlgorithm.String():
+		return NoAlgorithm, nil
+	case AutoAlgorithm.String():
+		return AutoAlgorithm, nil
+	}
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	for _, c := range codecs {
+		if c.name == name {
+			return c.algorithm, nil
+		}
+	}
+	return NoAlgorithm, fmt.Errorf("%w: algorithm %s", ErrUnknownValue, name)
+}
+
+// Algorithms returns the registered compression algorithms, excluding NoAlgorithm and AutoAlgorithm.
+func Algorithms() []Algorithm {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	algorithms := make([]Algorithm, 0, len(codecs))
+	for _, c := range codecs {
+		algorithms = append(algorithms, c.algorithm)
+	}
+	return algorithms
+}
+
+// CanCompress reports whether the algorithm is supported in tar creation.
+func (c Algorithm) CanCompress() bool {
+	if c == NoAlgorithm {
+		return true
+	}
+	codec := getCodec(c)
+	return codec != nil && codec.newWriter != nil
+}
+
+// getCodec returns the codec of a registered algorithm, or nil.
+func getCodec(algorithm Algorithm) *codec {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	for _, c := range codecs {
+		if c.algorithm == algorithm {
+			return c
+		}
+	}
+	return nil
+}
+
+// matchMagic returns the algorithm whose magic number is a prefix of b, or NoAlgorithm.
+func matchMagic(b []byte) Algorithm {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	for _, c := range codecs {
+		if c.match != nil {
+			if len(b) >= c.matchSize && c.match(b) {
+				return c.algorithm
+			}
+		} else if len(c.magic) > 0 && len(b) >= len(c.magic) && string(b[:len(c.magic)]) == string(c.magic) {
+			return c.algorithm
+		}
+	}
+	return NoAlgorithm
+}
+
+// maxMagicSize returns the number of bytes to read for detecting the compression algorithm.
+func maxMagicSize() int {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	size := len(xzMagic)
+	for _, c := range codecs {
+		if len(c.magic) > size {
+			size = len(c.magic)
+		}
+		if c.matchSize > size {
+			size = c.matchSize
+		}
+	}
+	return size
+}
+
+// newCompressor compresses to w with the algorithm, which mustn't be NoAlgorithm.
+func newCompressor(w io.Writer, algorithm Algorithm, level Level, threads int) (io.WriteCloser, error) {
+	c := getCodec(algorithm)
+	if c == nil || c.newWriter == nil {
+		return nil, fmt.Errorf("%w: %v in creation", ErrUnsupportedAlgorithm, algorithm)
+	}
+	cw, err := c.newWriter(w, level, getConcurrency(threads))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s writer: %w", c.name, err)
+	}
+	return cw, nil
+}
+
+// gzipLevels, lz4Levels and zstdLevels are the levels of the algorithms by Level.
+var (
+	gzipLevels = [...]int{
+		FastestLevel: gzip.BestSpeed,
+		FastLevel:    3,
+		DefaultLevel: gzip.DefaultCompression,
+		GoodLevel:    7,
+		BestLevel:    gzip.BestCompression,
+	}
+	lz4Levels = [...]lz4.CompressionLevel{
+		FastestLevel: lz4.Fast,
+		FastLevel:    lz4.Fast,
+		DefaultLevel: lz4.Fast,
+		GoodLevel:    lz4.Level5,
+		BestLevel:    lz4.Level9,
+	}
+	zstdLevels = [...]zstd.EncoderLevel{
+		FastestLevel: zstd.SpeedFastest,
+		FastLevel:    zstd.SpeedFastest,
+		DefaultLevel: zstd.SpeedDefault,
+		GoodLevel:    zstd.SpeedBetterCompression,
+		BestLevel:    zstd.SpeedBestCompression,
+	}
+)
+
+func newGzipWriter(w io.Writer, level Level, threads int) (io.WriteCloser, error) {
+	return newParallelGzipWriter(w, gzipLevels[level], threads)
+}
+
+func newGzipReader(r io.Reader, _ int) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func newLZ4Writer(w io.Writer, level Level, threads int) (io.WriteCloser, error) {
+	lw := lz4.NewWriter(w)
+	if err := lw.Apply(
+		lz4.ConcurrencyOption(threads),
+		lz4.ChecksumOption(false),
+		lz4.CompressionLevelOption(lz4Levels[level]),
+	); err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+func newLZ4Reader(r io.Reader, threads int) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	lr := lz4.NewReader(br)
+	if err := lr.Apply(lz4.ConcurrencyOption(threads)); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&lz4FramesReader{lr: lr, src: br}), nil
+}
+
+func newZstdWriter(w io.Writer, level Level, threads int) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevels[level]), zstd.WithEncoderConcurrency(threads))
+}
+
+func newZstdReader(r io.Reader, threads int) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(threads))
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// bzip2MagicSize is the size of the stream header "BZh" with the block size, and the magic of the first block.
+const bzip2MagicSize = 10
+
+// matchBzip2 matches the header of a bzip2 stream, followed by the magic of a block or the end of an empty stream.
+// "BZh" alone is too weak, as an uncompressed tarball can start with a file named like that.
+func matchBzip2(b []byte) bool {
+	if string(b[:3]) != "BZh" || b[3] < '1' || b[3] > '9' {
+		return false
+	}
+	block := string(b[4:bzip2MagicSize])
+	return block == "\x31\x41\x59\x26\x53\x59" || block == "\x17\x72\x45\x38\x50\x90"
+}
+
+func newBzip2Reader(r io.Reader, _ int) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(r)), nil
+}
@@ -0,0 +1,97 @@
+package vaar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+// xorMagic is the magic number of a toy codec, which flips all bits.
+var xorMagic = []byte("XOR1")
+
+type xorWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (w *xorWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		if _, err := w.w.Write(xorMagic); err != nil {
+			return 0, err
+		}
+		w.started = true
+	}
+	flipped := make([]byte, len(b))
+	for i, c := range b {
+		flipped[i] = ^c
+	}
+	return w.w.Write(flipped)
+}
+
+func (w *xorWriter) Close() error {
+	return nil
+}
+
+type xorReader struct {
+	r io.Reader
+}
+
+func (r *xorReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	for i := range b[:n] {
+		b[i] = ^b[i]
+	}
+	return n, err
+}
+
+var (
+	// xorAlgorithm is registered once, as codecs cannot be unregistered when the tests run repeatedly.
+	xorAlgorithm Algorithm
+	xorOnce      sync.Once
+)
+
+func TestRegisterCodec(t *testing.T) {
+	xorOnce.Do(func() {
+		xorAlgorithm = RegisterCodec("XOR", xorMagic, func(w io.Writer, level Level, threads int) (io.WriteCloser, error) {
+			if threads < 1 {
+				return nil, errors.New("invalid threads")
+			}
+			return &xorWriter{w: w}, nil
+		}, func(r io.Reader, threads int) (io.ReadCloser, error) {
+			magic := make([]byte, len(xorMagic))
+			if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, xorMagic) {
+				return nil, errors.New("invalid xor stream")
+			}
+			return io.NopCloser(&xorReader{r: r}), nil
+		})
+	})
+	algorithm := xorAlgorithm
+	assert.Equal(t, algorithm.String(), "xor")
+	assert.Assert(t, algorithm.CanCompress())
+	assert.Assert(t, !Bzip2Algorithm.CanCompress())
+	parsed, err := ParseAlgorithm("Xor")
+	assert.NilError(t, err)
+	assert.Equal(t, parsed, algorithm)
+	assert.DeepEqual(t, Algorithms()[:4], []Algorithm{GzipAlgorithm, LZ4Algorithm, ZstdAlgorithm, Bzip2Algorithm})
+	_, err = ParseAlgorithm("rot13")
+	assert.Assert(t, errors.Is(err, ErrUnknownValue))
+	assert.Assert(t, func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		RegisterCodec("xor", nil, nil, func(r io.Reader, threads int) (io.ReadCloser, error) { return nil, nil })
+		return false
+	}())
+	// The registered algorithm is used in creation and detected in extraction.
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithFile("file", "content")))
+	dstDir := roundTrip(t, srcDir.Join("data"), []Option{WithCompression(algorithm)}, WithCompression(AutoAlgorithm))
+	assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.ManifestFromDir(t, srcDir.Join("data"))))
+	// The writer can't be reset to cut frames.
+	_, err = NewComposer(io.Discard, WithCompression(algorithm), WithIndex(io.Discard))
+	assert.Assert(t, errors.Is(err, ErrUnsupportedAlgorithm))
+	_, err = NewComposer(io.Discard, WithCompression(Bzip2Algorithm))
+	assert.Assert(t, errors.Is(err, ErrUnsupportedAlgorithm))
+}
@@ -2,17 +2,20 @@ package vaar
 
 import (
 	"archive/tar"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/klauspost/compress/gzip"
-	"github.com/pierrec/lz4/v4"
+	"golang.org/x/sys/unix"
 )
 
 const (
+	composerDefaultThread    = 1
 	composerDefaultReadAhead = 512
 	composerDefaultBufSize   = 16 << 20 // 16 MiB
 )
@@ -20,14 +23,36 @@ const (
 // Composer is a tarball creation context.
 type Composer struct {
 	tw        *tar.Writer
+	w         io.Writer // The writer under tw, to write what tar.Writer doesn't support.
+	thread    int
 	readAhead int
 	bufSize   int
+	callback  Callback
+	filter    *filter
+	// Skip sockets, which cannot be archived.
+	skipUnsupported bool
+	xattrs          bool
+	sparse          bool
+	owner           ownership
+	names           NameResolver
+	snapshot        *Snapshot
+	index           *indexer
+	checksum        Checksum
+	// Update fields.
+	update   bool
+	archived map[string]time.Time // Modification times of the entries in the appended tarball by their names.
+	// Reproducible fields.
+	reproducible bool
+	epoch        time.Time // Modification times are clamped to it, if not zero.
 	// Compression fields.
-	algorithm   Algorithm
-	level       Level
-	extraCloser io.Closer
+	algorithm          Algorithm
+	level              Level
+	compressionThreads int
+	extraCloser        io.Closer
 	// Runtime fields.
-	buf []byte
+	buf   []byte
+	links map[fileID]string // Names of added files with multiple links, to detect hard links.
+	done  int64             // Bytes of file contents written, reported to the callback.
 }
 
 type addOperation struct {
@@ -37,10 +62,28 @@ type addOperation struct {
 
 // NewComposer creates a Composer with options, writing the tarball to w.
 func NewComposer(w io.Writer, options ...Option) (*Composer, error) {
+	c, err := newComposer(options)
+	if err != nil {
+		return nil, err
+	}
+	if c.update {
+		return nil, errors.New("update mode requires an appended tarball")
+	}
+	if err := c.init(w); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newComposer creates a Composer with the options applied, before it's initialized with the writer.
+func newComposer(options []Option) (*Composer, error) {
 	c := &Composer{
+		thread:    composerDefaultThread,
 		readAhead: composerDefaultReadAhead,
 		bufSize:   composerDefaultBufSize,
 		level:     DefaultLevel,
+		owner:     newOwnership(),
+		names:     defaultNameResolver,
 	}
 	// Apply options.
 	for _, option := range options {
@@ -48,33 +91,52 @@ func NewComposer(w io.Writer, options ...Option) (*Composer, error) {
 			return nil, err
 		}
 	}
+	if c.reproducible || c.owner.numeric {
+		// The names are not recorded. Don't bother looking them up.
+		c.names = NopNameResolver
+	}
+	if c.reproducible && c.compressionThreads == 0 {
+		// The number of CPUs varies among machines.
+		c.compressionThreads = 1
+	}
+	return c, nil
+}
+
+// init sets up the compression and the tar writer on w.
+func (c *Composer) init(w io.Writer) error {
+	if c.index != nil {
+		c.index.out = &countWriter{w: w}
+		w = c.index.out
+	}
 	// Apply the compression.
-	switch c.algorithm {
-	case GzipAlgorithm:
-		gw, err := gzip.NewWriterLevel(w, int(getCompressionLevel(GzipAlgorithm, c.level)))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create gzip writer: %w", err)
-		}
-		w = gw
-		c.extraCloser = gw
-	case LZ4Algorithm:
-		lw := lz4.NewWriter(w)
-		if err := lw.Apply(
-			lz4.ConcurrencyOption(-1),
-			lz4.ChecksumOption(false),
-			lz4.CompressionLevelOption(lz4.CompressionLevel(getCompressionLevel(LZ4Algorithm, c.level))),
-		); err != nil {
-			return nil, fmt.Errorf("failed to apply lz4 options: %w", err)
-		}
-		w = lw
-		c.extraCloser = lw
-	case NoAlgorithm:
-	default:
-		return nil, ErrUnsupportedAlgorithm
+	var cw io.WriteCloser
+	if c.algorithm != NoAlgorithm {
+		var err error
+		if cw, err = newCompressor(w, c.algorithm, c.level, c.compressionThreads); err != nil {
+			return err
+		}
+		w = cw
+		c.extraCloser = cw
 	}
+	if c.index != nil {
+		c.index.index = Index{Version: indexVersion, Algorithm: c.algorithm.String()}
+		if cw != nil {
+			// Frames are cut by closing and resetting the compression writer.
+			frame, ok := cw.(frameWriter)
+			if !ok {
+				return fmt.Errorf("%w: %v with index", ErrUnsupportedAlgorithm, c.algorithm)
+			}
+			c.index.frame = frame
+			c.index.index.Frames = []IndexFrame{{}}
+		}
+		c.index.raw = &countWriter{w: w}
+		w = c.index.raw
+	}
+	c.w = w
 	c.tw = tar.NewWriter(w)
 	c.buf = make([]byte, c.bufSize)
-	return c, nil
+	c.links = make(map[fileID]string)
+	return nil
 }
 
 // Add adds a path to the tarball.
@@ -83,51 +145,150 @@ func NewComposer(w io.Writer, options ...Option) (*Composer, error) {
 // The base argument is prepended to the paths of all files using filepath.Join.
 // In other words, if you call Add("/a/b/c", "d/e"), all files in /a/b/c are added as d/e/c/... including /a/b/c itself.
 func (c *Composer) Add(path, base string) error {
+	return c.AddContext(context.Background(), path, base)
+}
+
+// AddContext is like Add, but stops walking and writing when ctx is done.
+// In this case, the error of ctx is returned, wrapped with the file being added.
+// The tarball is incomplete afterwards, but Close can still be called to release the resources.
+func (c *Composer) AddContext(ctx context.Context, path, base string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("interrupted before adding %s: %w", path, err)
+	}
 	entry, err := Stat(path)
 	if err != nil {
 		return err
 	}
 	if !entry.IsDir() {
 		// If the path is a file, just add it and return.
-		header, err := getTarHeaderFromEntry(filepath.Join(base, filepath.Base(path)), entry)
+		if c.skipUnsupported && !isSupported(entry) {
+			return nil
+		}
+		header, err := getTarHeaderFromEntry(filepath.Join(base, filepath.Base(path)), entry, c.names)
 		if err != nil {
 			return fmt.Errorf("failed to generate header for %s: %w", path, err)
 		}
+		if err := c.fixHeader(header); err != nil {
+			return err
+		}
+		if c.snapshot != nil {
+			c.snapshot.addRoot(header.Name)
+		}
+		if c.filter != nil && c.filter.excluded(header.Name, false) {
+			return nil
+		}
+		isLink := c.linkHeader(header, entry)
+		if c.unchanged(header, entry) {
+			return nil
+		}
+		if isLink {
+			return c.writeFile(ctx, header, nil)
+		}
+		c.recordLink(header, entry)
+		if err := c.addXattrs(header, path, nil); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return c.writeFile(ctx, header, nil)
+		}
 		file, err := os.Open(path)
 		if err != nil {
 			return fmt.Errorf("failed to open %s: %w", path, err)
 		}
 		defer func() { _ = file.Close() }()
-		return c.writeFile(header, file)
+		return c.writeFile(ctx, header, file)
 	}
 	// Start a goroutine to add files.
 	opCh := make(chan *addOperation, c.readAhead)
 	errCh := make(chan error, 1)
 	doneCh := make(chan struct{})
-	go c.process(opCh, errCh, doneCh)
+	go c.process(ctx, opCh, errCh, doneCh)
 	// Walk to do recursive adding.
 	adsPath, err := filepath.Abs(path)
 	if err != nil {
 		return fmt.Errorf("failed to get absolute path of %s: %w", path, err)
 	}
 	dirBase := filepath.Dir(adsPath)
-	err = Walk(adsPath, func(path string, entry *Entry, r io.ReadCloser) error {
+	walkFunc := func(path string, entry *Entry, r io.ReadCloser) error {
+		closeReader := func() {
+			if r != nil {
+				_ = r.Close()
+			}
+		}
+		// Returning an error here stops the walking.
+		if err := ctx.Err(); err != nil {
+			closeReader()
+			return fmt.Errorf("interrupted when adding %s: %w", path, err)
+		}
 		relPath, err := filepath.Rel(dirBase, path)
 		if err != nil {
+			closeReader()
 			return fmt.Errorf("invalid path %s: %w", path, err)
 		}
+		if c.skipUnsupported && !isSupported(entry) {
+			closeReader()
+			return nil
+		}
 		name := filepath.Join(base, relPath)
-		header, err := getTarHeaderFromEntry(name, entry)
+		header, err := getTarHeaderFromEntry(name, entry, c.names)
 		if err != nil {
+			closeReader()
 			return err
 		}
+		if err := c.fixHeader(header); err != nil {
+			closeReader()
+			return err
+		}
+		if c.snapshot != nil && path == adsPath {
+			c.snapshot.addRoot(header.Name)
+		}
+		if c.filter != nil && c.filter.excluded(header.Name, entry.IsDir()) {
+			closeReader()
+			if entry.IsDir() {
+				// Don't walk into excluded directories.
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		isLink := c.linkHeader(header, entry)
+		if c.unchanged(header, entry) {
+			closeReader()
+			return nil
+		}
+		if isLink {
+			// The content has been added with the first link. No need to read it again.
+			closeReader()
+			r = nil
+		} else {
+			c.recordLink(header, entry)
+			if err := c.addXattrs(header, path, r); err != nil {
+				closeReader()
+				return err
+			}
+		}
 		select {
 		case opCh <- &addOperation{header: header, reader: r}:
 		case err := <-errCh:
+			closeReader()
 			return err
+		case <-ctx.Done():
+			closeReader()
+			return fmt.Errorf("interrupted when adding %s: %w", path, ctx.Err())
 		}
 		return nil
-	})
+	}
+	if c.thread > 1 {
+		var skipDir func(path string) bool
+		if c.filter != nil {
+			skipDir = func(path string) bool {
+				relPath, err := filepath.Rel(dirBase, path)
+				return err == nil && c.filter.excluded(filepath.Join(base, relPath), true)
+			}
+		}
+		err = parallelWalkPath(adsPath, c.thread, c.reproducible, skipDir, walkFunc)
+	} else {
+		err = walkPath(adsPath, c.reproducible, walkFunc)
+	}
 	close(opCh)
 	<-doneCh
 	if err != nil {
@@ -138,11 +299,14 @@ func (c *Composer) Add(path, base string) error {
 	return <-errCh
 }
 
-func (c *Composer) process(opCh <-chan *addOperation, errCh chan<- error, doneCh chan<- struct{}) {
+func (c *Composer) process(ctx context.Context, opCh <-chan *addOperation, errCh chan<- error, doneCh chan<- struct{}) {
 	defer close(doneCh)
 	for op := range opCh {
 		header, reader := op.header, op.reader
-		err := c.writeFile(header, reader)
+		err := ctx.Err()
+		if err == nil {
+			err = c.writeFile(ctx, header, reader)
+		}
 		if reader != nil {
 			_ = reader.Close()
 		}
@@ -159,12 +323,40 @@ func (c *Composer) process(opCh <-chan *addOperation, errCh chan<- error, doneCh
 	}
 }
 
-func (c *Composer) writeFile(header *tar.Header, reader io.Reader) error {
+func (c *Composer) writeFile(ctx context.Context, header *tar.Header, reader io.Reader) (err error) {
+	var n int64
+	if c.callback != nil {
+		defer func() {
+			c.done += n
+			c.callback(header, c.done, err)
+		}()
+	}
+	if c.index != nil {
+		if err := c.indexEntry(header); err != nil {
+			return fmt.Errorf("failed to index %s: %w", header.Name, err)
+		}
+	}
+	if file, ok := reader.(*os.File); ok && c.sparse && header.Typeflag == tar.TypeReg {
+		segments, err := findDataSegments(int(file.Fd()), header.Size)
+		if err != nil {
+			return fmt.Errorf("failed to find holes in %s: %w", header.Name, err)
+		}
+		if segments != nil {
+			if n, err = c.writeSparse(ctx, header, file, segments); err != nil {
+				return fmt.Errorf("failed to write sparse file %s: %w", header.Name, err)
+			}
+			return nil
+		}
+	}
+	if c.checksum != NoChecksum && header.Typeflag == tar.TypeReg {
+		n, err = c.writeChecksummedFile(ctx, header, reader)
+		return err
+	}
 	if err := c.tw.WriteHeader(header); err != nil {
 		return fmt.Errorf("failed to write header for %s: %w", header.Name, err)
 	}
 	if header.Typeflag == tar.TypeReg {
-		_, err := io.CopyBuffer(c.tw, reader, c.buf)
+		n, err = io.CopyBuffer(c.tw, newContextReader(ctx, reader), c.buf)
 		if err != nil {
 			return fmt.Errorf("failed to write body for %s: %w", header.Name, err)
 		}
@@ -172,6 +364,86 @@ func (c *Composer) writeFile(header *tar.Header, reader io.Reader) error {
 	return nil
 }
 
+// fixHeader sets the owners of a header generated from a file, and normalizes it in reproducible mode.
+func (c *Composer) fixHeader(header *tar.Header) error {
+	if c.reproducible {
+		// The owners are zeroed, unless overridden.
+		c.normalizeHeader(header)
+		c.owner.overrideOwner(header)
+		return nil
+	}
+	return c.owner.archiveOwner(header)
+}
+
+// normalizeHeader removes what depends on the machine and the time of checkout from the header in reproducible mode.
+// The owners are zeroed, the access and change times are dropped, and the modification time is clamped to the epoch.
+func (c *Composer) normalizeHeader(header *tar.Header) {
+	if !c.reproducible {
+		return
+	}
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	if !c.epoch.IsZero() && header.ModTime.After(c.epoch) {
+		header.ModTime = c.epoch
+	}
+}
+
+// unchanged reports whether a file can be skipped, as it's unchanged since the snapshot,
+// or not newer than the archived one in update mode. Directories are still walked into.
+func (c *Composer) unchanged(header *tar.Header, entry *Entry) bool {
+	unchanged := c.snapshot != nil && c.snapshot.record(header.Name, entry)
+	return unchanged || c.update && !c.newer(header)
+}
+
+// linkHeader turns the header into a hard link, if the file has been added before with another name.
+// It reports whether the header is modified. Directories are never considered.
+func (c *Composer) linkHeader(header *tar.Header, entry *Entry) bool {
+	if entry.nlink < 2 || entry.IsDir() {
+		return false
+	}
+	linkname, ok := c.links[fileID{dev: entry.dev, ino: entry.ino}]
+	if !ok {
+		return false
+	}
+	header.Typeflag = tar.TypeLink
+	header.Linkname = linkname
+	header.Size = 0
+	return true
+}
+
+// recordLink records the file as the target of later hard links to it. It must be called only when the file
+// is going to be written, after the skip checks, so that no hard link points to a file absent from the tarball.
+// Files are written in the order they're recorded, so the target always precedes the links.
+func (c *Composer) recordLink(header *tar.Header, entry *Entry) {
+	if entry.nlink < 2 || entry.IsDir() {
+		return
+	}
+	c.links[fileID{dev: entry.dev, ino: entry.ino}] = header.Name
+}
+
+// addXattrs reads the extended attributes of a file into the header, if enabled.
+// If r is an opened file, it's used instead of the path.
+func (c *Composer) addXattrs(header *tar.Header, path string, r io.Reader) error {
+	if !c.xattrs {
+		return nil
+	}
+	var (
+		xattrs map[string]string
+		err    error
+	)
+	if file, ok := r.(*os.File); ok {
+		xattrs, err = readFileXattrs(int(file.Fd()))
+	} else {
+		xattrs, err = readPathXattrs(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read extended attributes of %s: %w", path, err)
+	}
+	setHeaderXattrs(header, xattrs)
+	return nil
+}
+
 // TarWriter returns the underlying tar.Writer.
 // It's for manual operations like adding files only. It mustn't be closed.
 func (c *Composer) TarWriter() *tar.Writer {
@@ -179,20 +451,34 @@ func (c *Composer) TarWriter() *tar.Writer {
 }
 
 // Close completes the tarball creation. It must be called to flush the buffered bytes.
+// With WithSnapshot, the files deleted since the snapshot are listed in the end, and the snapshot is updated.
 func (c *Composer) Close() error {
+	if c.snapshot != nil {
+		if deleted := c.snapshot.commit(); len(deleted) > 0 {
+			if err := c.tw.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{paxDeleted: strings.Join(deleted, "\x00")},
+			}); err != nil {
+				return fmt.Errorf("failed to write the deleted files: %w", err)
+			}
+		}
+	}
+	// The tar writer must be closed first, so that the trailer is compressed too.
+	if err := c.tw.Close(); err != nil {
+		return fmt.Errorf("failed to close internal tar writer: %w", err)
+	}
 	if c.extraCloser != nil {
 		if err := c.extraCloser.Close(); err != nil {
 			return fmt.Errorf("failed to close compression writer: %w", err)
 		}
 	}
-	if err := c.tw.Close(); err != nil {
-		return fmt.Errorf("failed to close internal tar writer: %w", err)
+	if c.index != nil {
+		return c.writeIndex()
 	}
 	return nil
 }
 
-// TODO: support hard links.
-func getTarHeaderFromEntry(name string, entry *Entry) (*tar.Header, error) {
+func getTarHeaderFromEntry(name string, entry *Entry, names NameResolver) (*tar.Header, error) {
 	header, err := tar.FileInfoHeader(entry, entry.linkname)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate header for file %s: %w", name, err)
@@ -208,7 +494,17 @@ func getTarHeaderFromEntry(name string, entry *Entry) (*tar.Header, error) {
 	// Fill in the owner fields.
 	header.Uid = int(entry.uid)
 	header.Gid = int(entry.gid)
-	header.Uname = entry.uname
-	header.Gname = entry.gname
+	header.Uname = names.User(entry.uid)
+	header.Gname = names.Group(entry.gid)
+	// Fill in the device numbers.
+	if entry.mode&os.ModeDevice != 0 {
+		header.Devmajor = int64(unix.Major(entry.rdev))
+		header.Devminor = int64(unix.Minor(entry.rdev))
+	}
 	return header, nil
 }
+
+// isSupported reports whether a file can be archived.
+func isSupported(entry *Entry) bool {
+	return entry.mode&os.ModeSocket == 0
+}
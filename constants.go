@@ -9,19 +9,23 @@ const (
 	NoAlgorithm Algorithm = iota
 	GzipAlgorithm
 	LZ4Algorithm
+	ZstdAlgorithm
+	Bzip2Algorithm // Only supported in extraction.
+	AutoAlgorithm  // Detects the algorithm from the magic number. Only supported in extraction.
+	// More algorithms can be added by RegisterCodec.
 )
 
 func (c Algorithm) String() string {
 	switch c {
 	case NoAlgorithm:
 		return "none"
-	case GzipAlgorithm:
-		return "gzip"
-	case LZ4Algorithm:
-		return "lz4"
-	default:
-		return unknownValue
+	case AutoAlgorithm:
+		return "auto"
 	}
+	if codec := getCodec(c); codec != nil {
+		return codec.name
+	}
+	return unknownValue
 }
 
 // Level is the compression level.
@@ -51,3 +55,28 @@ func (l Level) String() string {
 		return unknownValue
 	}
 }
+
+// Checksum is the hash algorithm of the checksums of file contents.
+type Checksum uint8
+
+const (
+	NoChecksum Checksum = iota
+	SHA256Checksum
+	BLAKE3Checksum
+	XXH3Checksum // The 64-bit XXH3, which is fast but not cryptographic.
+)
+
+func (c Checksum) String() string {
+	switch c {
+	case NoChecksum:
+		return "none"
+	case SHA256Checksum:
+		return "sha256"
+	case BLAKE3Checksum:
+		return "blake3"
+	case XXH3Checksum:
+		return "xxh3"
+	default:
+		return unknownValue
+	}
+}
@@ -0,0 +1,446 @@
+package vaar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const differBufSize = 1 << 20 // 1 MiB
+
+// DiffKind is the kind of a difference between a tarball and a directory.
+type DiffKind uint8
+
+const (
+	MissingDiff DiffKind = iota // The entry is in the tarball, but not in the directory.
+	ExtraDiff                   // The file is in the directory, but not in the tarball.
+	TypeDiff
+	ContentDiff // The content, symlink target, hard link target or device number differs.
+	ModeDiff
+	OwnerDiff
+	ModTimeDiff
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case MissingDiff:
+		return "missing"
+	case ExtraDiff:
+		return "extra"
+	case TypeDiff:
+		return "type"
+	case ContentDiff:
+		return "content"
+	case ModeDiff:
+		return "mode"
+	case OwnerDiff:
+		return "owner"
+	case ModTimeDiff:
+		return "mtime"
+	default:
+		return unknownValue
+	}
+}
+
+// Difference is a difference between an entry in a tarball and a file in a directory.
+type Difference struct {
+	Name   string // The cleaned path in the tarball, or relative to the directory for extra files.
+	Kind   DiffKind
+	Detail string // The values in the tarball and in the directory, if any.
+}
+
+func (d *Difference) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s: %v", d.Name, d.Kind)
+	}
+	return fmt.Sprintf("%s: %v differs (%s)", d.Name, d.Kind, d.Detail)
+}
+
+// DiffFunc is the type of the function called by Diff for each difference found.
+type DiffFunc func(d *Difference) error
+
+// Differ is the context used when a tarball is compared with a directory.
+// It shouldn't be used directly. Use Diff instead.
+type Differ struct {
+	tr       *tar.Reader
+	root     string
+	diffFunc DiffFunc
+	filter   *filter
+	owner    ownership
+	// Compression fields.
+	algorithm          Algorithm
+	compressionThreads int
+	extraCloser        io.Closer
+	// Runtime fields.
+	buf     []byte
+	rootFd  int                       // The opened root directory, beneath which files not opened by Walk are opened.
+	entries map[string]*archivedEntry // Entries in the tarball not compared yet by their cleaned names.
+	dirs    map[string]bool           // Directories in the tarball (true) or parent directories not in it (false).
+}
+
+// archivedEntry is what's compared of an entry read from the tarball, without its content.
+type archivedEntry struct {
+	typeflag byte
+	mode     int64
+	uid, gid int // The owners as they would be restored in extraction.
+	modTime  time.Time
+	size     int64
+	linkname string // The target of a symlink, or the cleaned target of a hard link.
+	devmajor int64
+	devminor int64
+	sum      []byte // The SHA-256 of the content of a regular file.
+}
+
+// Diff takes a tarball (optionally compressed) from r and compares it with the directory at path with options,
+// as if the tarball was extracted there. diffFunc is called for each difference found.
+// Files not in the tarball are reported only if they are in directories in the tarball.
+// The tarball is streamed first, keeping the compared fields and the hashes of file contents only.
+// Then the directory is walked, and the files are hashed as they are read.
+// Entries missing in the directory are reported in the end, sorted by their names.
+// An error returned by diffFunc stops the comparison and is returned directly.
+func Diff(r io.Reader, path string, diffFunc DiffFunc, options ...Option) error {
+	d := newDiffer(diffFunc)
+	for _, option := range options {
+		if err := option(d); err != nil {
+			return err
+		}
+	}
+	if err := d.openRoot(path); err != nil {
+		return err
+	}
+	defer func() { _ = unix.Close(d.rootFd) }()
+	tr, closer, err := newTarReader(r, d.algorithm, d.compressionThreads)
+	if err != nil {
+		return err
+	}
+	d.tr, d.extraCloser = tr, closer
+	defer func() {
+		if d.extraCloser != nil {
+			_ = d.extraCloser.Close()
+		}
+	}()
+	if err := d.readStream(); err != nil {
+		return err
+	}
+	if err := Walk(d.root, d.compare); err != nil {
+		return err
+	}
+	// Entries compared have been dropped, so the rest are missing.
+	missing := make([]string, 0, len(d.entries))
+	for name := range d.entries {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		if err := d.diffFunc(&Difference{Name: name, Kind: MissingDiff}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDiffer(diffFunc DiffFunc) *Differ {
+	return &Differ{
+		diffFunc: diffFunc,
+		buf:      make([]byte, differBufSize),
+		rootFd:   -1,
+		entries:  make(map[string]*archivedEntry),
+		dirs:     make(map[string]bool),
+		owner:    newOwnership(),
+	}
+}
+
+// openRoot opens the directory to compare.
+func (d *Differ) openRoot(path string) error {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path of %s: %w", path, err)
+	}
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", root, err)
+	}
+	d.root, d.rootFd = root, fd
+	return nil
+}
+
+// readStream reads all entries in the tarball and hashes the contents of regular files.
+func (d *Differ) readStream() error {
+	for {
+		header, err := d.tr.Next()
+		if err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("failed to read from tar stream: %w", err)
+			}
+			return nil
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := path.Clean(strings.TrimLeft(header.Name, "/"))
+		if d.filter != nil && d.filter.excluded(name, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+		uid, gid, err := d.owner.hostOwner(header)
+		if err != nil {
+			return err
+		}
+		entry := &archivedEntry{
+			typeflag: header.Typeflag,
+			mode:     header.Mode,
+			uid:      uid,
+			gid:      gid,
+			modTime:  header.ModTime,
+			size:     header.Size,
+			linkname: header.Linkname,
+			devmajor: header.Devmajor,
+			devminor: header.Devminor,
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			h := sha256.New()
+			if _, err := io.CopyBuffer(h, d.tr, d.buf); err != nil {
+				return fmt.Errorf("failed to read %s from tar stream: %w", header.Name, err)
+			}
+			entry.sum = h.Sum(nil)
+		case tar.TypeLink:
+			entry.linkname = path.Clean(strings.TrimLeft(header.Linkname, "/"))
+		}
+		// The last one wins, the same as extraction.
+		d.entries[name] = entry
+		if header.Typeflag == tar.TypeDir {
+			d.dirs[name] = true
+		} else if d.dirs[name] {
+			d.dirs[name] = false
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := d.dirs[dir]; ok {
+				break
+			}
+			d.dirs[dir] = false
+		}
+	}
+}
+
+// compare is the WalkFunc comparing a file in the directory with the entry in the tarball.
+func (d *Differ) compare(filePath string, file *Entry, r io.ReadCloser) error {
+	if r != nil {
+		defer func() { _ = r.Close() }()
+	}
+	rel, err := filepath.Rel(d.root, filePath)
+	if err != nil {
+		return fmt.Errorf("invalid path %s: %w", filePath, err)
+	}
+	name := filepath.ToSlash(rel)
+	if d.filter != nil && name != "." && d.filter.excluded(name, file.IsDir()) {
+		return skipWalk(file)
+	}
+	entry, ok := d.entries[name]
+	if !ok {
+		if _, ok := d.dirs[name]; ok || name == "." {
+			// The parent directories are not necessarily in the tarball. Walk into them.
+			return nil
+		}
+		if !d.dirs[path.Dir(name)] {
+			// Files are extra only in the directories in the tarball. Others are irrelevant.
+			return skipWalk(file)
+		}
+		// Everything in an extra directory is extra too, so it's reported only once.
+		if err := d.diffFunc(&Difference{Name: name, Kind: ExtraDiff}); err != nil {
+			return err
+		}
+		return skipWalk(file)
+	}
+	// Each path is walked once, so the entry is no longer needed.
+	delete(d.entries, name)
+	var diffs []*Difference
+	report := func(kind DiffKind, format string, archived, actual interface{}) {
+		diffs = append(diffs, &Difference{
+			Name:   name,
+			Kind:   kind,
+			Detail: fmt.Sprintf(format+" in tarball, "+format+" on disk", archived, actual),
+		})
+	}
+	if entry.typeflag == tar.TypeLink {
+		// A hard link has the type and the metadata of its target.
+		stat, err := d.statFile(entry.linkname)
+		if err != nil || uint64(stat.Dev) != file.dev || uint64(stat.Ino) != file.ino {
+			report(ContentDiff, "link to %s", entry.linkname, "not linked")
+		}
+		return d.report(diffs)
+	}
+	if fileType := headerFileType(entry.typeflag); fileType != file.Mode().Type() {
+		report(TypeDiff, "%v", fileTypeName(fileType), fileTypeName(file.Mode().Type()))
+		if err := d.report(diffs); err != nil {
+			return err
+		}
+		return skipWalk(file)
+	}
+	switch entry.typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if entry.size != file.Size() {
+			report(ContentDiff, "size %d", entry.size, file.Size())
+			break
+		}
+		if r == nil {
+			// Walk only opens files whose types are known from the directory entries.
+			if r, err = d.openFile(name); err != nil {
+				return fmt.Errorf("failed to open %s: %w", filePath, err)
+			}
+			defer func() { _ = r.Close() }()
+		}
+		h := sha256.New()
+		if _, err := io.CopyBuffer(h, r, d.buf); err != nil {
+			return fmt.Errorf("failed to read %s: %w", filePath, err)
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, entry.sum) {
+			report(ContentDiff, "sha256 %x", entry.sum, sum)
+		}
+	case tar.TypeSymlink:
+		if entry.linkname != file.Linkname() {
+			report(ContentDiff, "target %s", entry.linkname, file.Linkname())
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		archived := fmt.Sprintf("%d,%d", entry.devmajor, entry.devminor)
+		actual := fmt.Sprintf("%d,%d", unix.Major(file.rdev), unix.Minor(file.rdev))
+		if archived != actual {
+			report(ContentDiff, "device %s", archived, actual)
+		}
+	}
+	// The modes and the times of symlinks are not restored in extraction, so they're not compared.
+	if entry.typeflag != tar.TypeSymlink {
+		if mode := fileModeBits(file.Mode()); entry.mode&0o7777 != mode {
+			report(ModeDiff, "%04o", entry.mode&0o7777, mode)
+		}
+		if !sameModTime(entry.modTime, file.ModTime()) {
+			report(ModTimeDiff, "%v", entry.modTime, file.ModTime())
+		}
+	}
+	if uint32(entry.uid) != file.uid || uint32(entry.gid) != file.gid {
+		report(OwnerDiff, "%s", fmt.Sprintf("%d:%d", entry.uid, entry.gid), fmt.Sprintf("%d:%d", file.uid, file.gid))
+	}
+	return d.report(diffs)
+}
+
+// report calls diffFunc for the differences.
+func (d *Differ) report(diffs []*Difference) error {
+	for _, diff := range diffs {
+		if err := d.diffFunc(diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openFile opens the regular file with the name beneath the root, without following symlinks.
+func (d *Differ) openFile(name string) (io.ReadCloser, error) {
+	dirFd, err := openBeneath(d.rootFd, path.Dir(name), false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unix.Close(dirFd) }()
+	fd, err := unix.Openat(dirFd, path.Base(name), unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// statFile stats the file with the name beneath the root, without following symlinks.
+func (d *Differ) statFile(name string) (*unix.Stat_t, error) {
+	if err := validateRelPath(name); err != nil {
+		return nil, err
+	}
+	dirFd, err := openBeneath(d.rootFd, path.Dir(name), false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unix.Close(dirFd) }()
+	var stat unix.Stat_t
+	if err := unix.Fstatat(dirFd, path.Base(name), &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+// skipWalk returns filepath.SkipDir for a directory, so that the walking doesn't go into it.
+func skipWalk(file *Entry) error {
+	if file.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// headerFileType returns the file type of the tar type flag, in the same bits as os.FileMode.Type.
+func headerFileType(typeflag byte) os.FileMode {
+	switch typeflag {
+	case tar.TypeDir:
+		return os.ModeDir
+	case tar.TypeSymlink:
+		return os.ModeSymlink
+	case tar.TypeChar:
+		return os.ModeDevice | os.ModeCharDevice
+	case tar.TypeBlock:
+		return os.ModeDevice
+	case tar.TypeFifo:
+		return os.ModeNamedPipe
+	default:
+		return 0
+	}
+}
+
+// fileTypeName returns a human-readable name of a file type.
+func fileTypeName(fileType os.FileMode) string {
+	switch fileType {
+	case 0:
+		return "regular file"
+	case os.ModeDir:
+		return "directory"
+	case os.ModeSymlink:
+		return "symlink"
+	case os.ModeDevice | os.ModeCharDevice:
+		return "character device"
+	case os.ModeDevice:
+		return "block device"
+	case os.ModeNamedPipe:
+		return "named pipe"
+	case os.ModeSocket:
+		return "socket"
+	default:
+		return fileType.String()
+	}
+}
+
+// fileModeBits converts the permission bits of os.FileMode to the Unix ones, including setuid, setgid and sticky.
+func fileModeBits(mode os.FileMode) int64 {
+	bits := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= unix.S_ISVTX
+	}
+	return bits
+}
+
+// sameModTime reports whether the modification time archived is the same as modTime.
+// Times without sub-second precision are compared by seconds.
+func sameModTime(archived, modTime time.Time) bool {
+	if archived.Nanosecond() == 0 {
+		return archived.Unix() == modTime.Unix()
+	}
+	return archived.Equal(modTime)
+}
@@ -0,0 +1,126 @@
+package vaar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func TestDiff(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content"),
+			fs.WithFile("file2", "content"),
+			fs.WithFile("file3", "content"),
+			fs.WithSymlink("link1", "file1"),
+			fs.WithDir("sub", fs.WithFile("file4", "content")),
+			fs.WithDir("excluded", fs.WithFile("file5", "content")),
+		),
+	)
+	assert.NilError(t, os.Link(srcDir.Join("data", "file1"), srcDir.Join("data", "sub", "hardlink1")))
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf, WithCompression(GzipAlgorithm))
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	diff := func(options ...Option) []string {
+		var diffs []string
+		options = append(options, WithCompression(AutoAlgorithm))
+		err := Diff(bytes.NewReader(buf.Bytes()), srcDir.Path(), func(d *Difference) error {
+			diffs = append(diffs, d.Name+" "+d.Kind.String())
+			return nil
+		}, options...)
+		assert.NilError(t, err)
+		return diffs
+	}
+	assert.Equal(t, len(diff()), 0)
+	// Make some changes.
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "file1"), []byte("changed"), 0o644))
+	assert.NilError(t, os.Chmod(srcDir.Join("data", "file2"), 0o600))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NilError(t, os.Chtimes(srcDir.Join("data", "file3"), mtime, mtime))
+	assert.NilError(t, os.Remove(srcDir.Join("data", "link1")))
+	assert.NilError(t, os.Symlink("file2", srcDir.Join("data", "link1")))
+	assert.NilError(t, os.Remove(srcDir.Join("data", "sub", "file4")))
+	assert.NilError(t, os.Mkdir(srcDir.Join("data", "sub", "extra"), 0o755))
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "sub", "extra", "file"), nil, 0o644))
+	assert.NilError(t, os.Remove(srcDir.Join("data", "excluded", "file5")))
+	// Files outside the directories in the tarball are irrelevant.
+	assert.NilError(t, os.WriteFile(srcDir.Join("irrelevant"), nil, 0o644))
+	diffs := diff(WithExclude("excluded"))
+	// The order is undetermined, except that missing entries are in the end.
+	assert.Equal(t, diffs[len(diffs)-1], "data/sub/file4 missing")
+	expected := map[string]bool{
+		"data mtime":             true,
+		"data/file1 content":     true,
+		"data/file1 mtime":       true,
+		"data/file2 mode":        true,
+		"data/file3 mtime":       true,
+		"data/link1 content":     true,
+		"data/sub mtime":         true,
+		"data/sub/extra extra":   true,
+		"data/sub/file4 missing": true,
+	}
+	assert.Equal(t, len(diffs), len(expected), "%v", diffs)
+	for _, d := range diffs {
+		assert.Assert(t, expected[d], "unexpected difference %s in %v", d, diffs)
+	}
+}
+
+func TestDiffUnopenedFiles(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithFile("file", "content"), fs.WithDir("sub", fs.WithFile("file", "content"))))
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf)
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	stat, err := os.Stat(srcDir.Join("data", "sub", "file"))
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "sub", "file"), []byte("CONTENT"), 0o644))
+	assert.NilError(t, os.Chtimes(srcDir.Join("data", "sub", "file"), stat.ModTime(), stat.ModTime()))
+	// Walk doesn't open files whose types are unknown from the directory entries, like on some filesystems.
+	var diffs []string
+	d := newDiffer(func(d *Difference) error {
+		diffs = append(diffs, d.Name+" "+d.Kind.String())
+		return nil
+	})
+	assert.NilError(t, d.openRoot(srcDir.Path()))
+	defer func() { _ = unix.Close(d.rootFd) }()
+	d.tr = tar.NewReader(&buf)
+	assert.NilError(t, d.readStream())
+	assert.NilError(t, Walk(d.root, func(path string, entry *Entry, r io.ReadCloser) error {
+		if r != nil {
+			_ = r.Close()
+		}
+		return d.compare(path, entry, nil)
+	}))
+	assert.DeepEqual(t, diffs, []string{"data/sub/file content"})
+	// The entries are dropped once compared.
+	assert.Equal(t, len(d.entries), 0)
+}
+
+func TestDiffHardLinkBeneathRoot(t *testing.T) {
+	outside := fs.NewDir(t, "outside", fs.WithFile("file", "content"))
+	root := fs.NewDir(t, "root")
+	assert.NilError(t, os.Symlink(outside.Path(), root.Join("escape")))
+	assert.NilError(t, os.Link(outside.Join("file"), root.Join("link")))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "escape/file"}))
+	assert.NilError(t, tw.Close())
+	// The target is not resolved through the symlink out of the root.
+	var diffs []string
+	assert.NilError(t, Diff(&buf, root.Path(), func(d *Difference) error {
+		diffs = append(diffs, d.Name+" "+d.Kind.String())
+		return nil
+	}))
+	assert.DeepEqual(t, diffs, []string{"link content"})
+}
@@ -1,9 +1,39 @@
 package vaar
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrInapplicableOption   = errors.New("option not inapplicable")
 	ErrUnknownValue         = errors.New("value is unknown")
 	ErrUnsupportedAlgorithm = errors.New("algorithm unsupported")
 )
+
+// UnsafePathError is returned when an entry would be extracted outside the target path,
+// either by its name like "../a", or through a symlink extracted before, like "a/b" after "a -> /etc".
+type UnsafePathError struct {
+	Name string // The name of the entry, or the target of a hard link.
+	Err  error
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path %s: %v", e.Name, e.Err)
+}
+
+func (e *UnsafePathError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumError is returned when the content of a file extracted doesn't match its checksum in the tarball.
+type ChecksumError struct {
+	Name     string // The name of the entry.
+	Checksum Checksum
+	Expected string // The hex digest in the tarball.
+	Actual   string // The hex digest of the content read.
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v checksum mismatch of %s: %s in tarball, %s actually", e.Checksum, e.Name, e.Expected, e.Actual)
+}
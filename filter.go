@@ -0,0 +1,166 @@
+package vaar
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// filter decides whether entries are skipped by their paths in the tarball, with gitignore-style glob patterns.
+type filter struct {
+	excludes []*pattern
+	includes []*pattern
+}
+
+// pattern is a compiled glob pattern.
+type pattern struct {
+	segments []string // The pattern split by slashes. A "**" segment matches zero or more path components.
+	dirOnly  bool     // The pattern ends with a slash, so that it only matches directories.
+}
+
+// compilePattern compiles a gitignore-style glob pattern. In addition to the syntax of path.Match:
+//   1. A pattern without slashes, except a trailing one, matches at any depth. Otherwise, it's relative to the root.
+//   2. A "**" component matches zero or more components, like "**/build", "a/**/b" and "logs/**".
+//   3. A pattern ending with a slash only matches directories.
+// A pattern matching a directory also matches all files in it.
+func compilePattern(s string) (*pattern, error) {
+	if strings.HasPrefix(s, "!") {
+		return nil, fmt.Errorf("negative pattern %s is unsupported", s)
+	}
+	p := &pattern{dirOnly: strings.HasSuffix(s, "/")}
+	trimmed := strings.TrimRight(s, "/")
+	anchored := strings.Contains(trimmed, "/")
+	trimmed = strings.TrimLeft(trimmed, "/")
+	if trimmed == "" {
+		return nil, fmt.Errorf("empty pattern %q", s)
+	}
+	if !anchored {
+		p.segments = append(p.segments, "**")
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		if segment == "" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", s, err)
+		}
+		p.segments = append(p.segments, segment)
+	}
+	return p, nil
+}
+
+// match reports whether the pattern matches the path components of an entry.
+func (p *pattern) match(components []string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(p.segments, components)
+}
+
+// matchSegments matches path components with pattern segments, in which "**" matches zero or more components.
+func matchSegments(segments, components []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			segments = segments[1:]
+			if len(segments) == 0 {
+				// A trailing "**" matches everything inside, but not the directory itself.
+				return len(components) > 0
+			}
+			for i := 0; i <= len(components); i++ {
+				if matchSegments(segments, components[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(components) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(segments[0], components[0]); !ok {
+			return false
+		}
+		segments, components = segments[1:], components[1:]
+	}
+	return len(components) == 0
+}
+
+// matchAny reports whether any of the patterns matches the path components.
+func matchAny(patterns []*pattern, components []string, isDir bool) bool {
+	for _, p := range patterns {
+		if p.match(components, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// addExcludes compiles and adds exclude patterns.
+func (f *filter) addExcludes(patterns []string) error {
+	for _, s := range patterns {
+		p, err := compilePattern(s)
+		if err != nil {
+			return err
+		}
+		f.excludes = append(f.excludes, p)
+	}
+	return nil
+}
+
+// addIncludes compiles and adds include patterns.
+func (f *filter) addIncludes(patterns []string) error {
+	for _, s := range patterns {
+		p, err := compilePattern(s)
+		if err != nil {
+			return err
+		}
+		f.includes = append(f.includes, p)
+	}
+	return nil
+}
+
+// excluded reports whether an entry should be skipped.
+// An entry is skipped if it or any of its parent directories matches an exclude pattern.
+// If there are include patterns, an entry other than a directory is also skipped,
+// unless it or any of its parent directories matches one of them.
+func (f *filter) excluded(name string, isDir bool) bool {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	components := strings.Split(name, "/")
+	for i := 1; i <= len(components); i++ {
+		if matchAny(f.excludes, components[:i], i < len(components) || isDir) {
+			return true
+		}
+	}
+	if len(f.includes) == 0 || isDir {
+		return false
+	}
+	for i := 1; i <= len(components); i++ {
+		if matchAny(f.includes, components[:i], i < len(components)) {
+			return false
+		}
+	}
+	return true
+}
+
+// readPatternFile reads patterns from a file, one per line. Empty lines and lines starting with # are ignored.
+func readPatternFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pattern file %s: %w", name, err)
+	}
+	defer func() { _ = file.Close() }()
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pattern file %s: %w", name, err)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,97 @@
+package vaar
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func Test_filter(t *testing.T) {
+	f := &filter{}
+	assert.NilError(t, f.addExcludes([]string{"node_modules", "*.o", "/root/build/", "a/**/z", "logs/**"}))
+	assert.Assert(t, f.excluded("node_modules", true))
+	assert.Assert(t, f.excluded("src/node_modules", true))
+	assert.Assert(t, f.excluded("src/node_modules/lib/index.js", false))
+	assert.Assert(t, f.excluded("main.o", false))
+	assert.Assert(t, f.excluded("src/main.o", false))
+	assert.Assert(t, !f.excluded("src/main.c", false))
+	assert.Assert(t, f.excluded("root/build", true))
+	assert.Assert(t, f.excluded("/root/build/out", false))
+	assert.Assert(t, !f.excluded("root/build", false))
+	assert.Assert(t, !f.excluded("src/root/build", true))
+	assert.Assert(t, f.excluded("a/z", false))
+	assert.Assert(t, f.excluded("a/b/c/z", false))
+	assert.Assert(t, !f.excluded("b/a/z", false))
+	assert.Assert(t, f.excluded("logs/x/y", false))
+	assert.Assert(t, !f.excluded("logs", true))
+	f = &filter{}
+	assert.NilError(t, f.addIncludes([]string{"*.go", "docs"}))
+	assert.Assert(t, !f.excluded("src", true))
+	assert.Assert(t, !f.excluded("src/main.go", false))
+	assert.Assert(t, !f.excluded("docs/README.md", false))
+	assert.Assert(t, f.excluded("src/README.md", false))
+	_, err := compilePattern("[a")
+	assert.ErrorContains(t, err, "invalid pattern")
+	_, err = compilePattern("!a")
+	assert.ErrorContains(t, err, "unsupported")
+}
+
+func TestFilter(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("main.go", "package main"),
+			fs.WithFile("main.o", "binary"),
+			fs.WithDir(".git", fs.WithFile("HEAD", "ref")),
+			fs.WithDir("sub", fs.WithFile("lib.go", "package sub")),
+		),
+	)
+	patternFile := fs.NewFile(t, "patterns", fs.WithContent("# Comment\n\n.git/\n"))
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf, WithExclude("*.o"), WithExcludeFrom(patternFile.Path()))
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(&buf, dstDir.Path(), WithExclude("data/sub")))
+	assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.Expected(
+		t,
+		fs.MatchAnyFileMode,
+		fs.WithFile("main.go", "package main", fs.MatchAnyFileMode),
+	)))
+}
+
+func TestFilterParallel(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("main.go", "package main"),
+			fs.WithDir("private", fs.WithFile("key", "secret")),
+		),
+	)
+	// Reading a directory updates its access time if it's older than the modification time.
+	private := srcDir.Join("data", "private")
+	atime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NilError(t, os.Chtimes(private, atime, time.Now()))
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf, WithThread(4), WithExclude("private/"))
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	// Excluded directories are never read ahead.
+	var stat unix.Stat_t
+	assert.NilError(t, unix.Stat(private, &stat))
+	assert.Equal(t, time.Unix(stat.Atim.Sec, stat.Atim.Nsec), atime)
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(&buf, dstDir.Path()))
+	assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.Expected(
+		t,
+		fs.MatchAnyFileMode,
+		fs.WithFile("main.go", "package main", fs.MatchAnyFileMode),
+	)))
+}
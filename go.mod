@@ -5,6 +5,8 @@ go 1.16
 require (
 	github.com/klauspost/compress v1.15.0
 	github.com/pierrec/lz4/v4 v4.1.14
+	github.com/zeebo/blake3 v0.2.3
+	github.com/zeebo/xxh3 v1.0.1
 	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5
 	gotest.tools/v3 v3.1.0
 )
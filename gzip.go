@@ -0,0 +1,302 @@
+package vaar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	gzipBlockSize = 1 << 20  // 1 MiB, the uncompressed size of a block compressed on its own.
+	gzipDictSize  = 32 << 10 // 32 KiB, the window of deflate.
+	readAheadSize = 64 << 10 // 64 KiB, the size of a buffer decompressed ahead, small to keep Close short.
+	readAheadN    = 16       // The number of buffers decompressed ahead.
+)
+
+// gzipHeader is the header of a gzip member without a name or a modification time, from an unknown OS.
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+
+// gzipFinalBlock is an empty final deflate block with fixed Huffman codes, ending the deflate stream.
+var gzipFinalBlock = []byte{0x03, 0x00}
+
+// parallelGzipWriter compresses data into a gzip stream with multiple threads, like pgzip.
+// The data is cut into blocks of gzipBlockSize, which are deflated concurrently with the end of the previous block
+// as the dictionary, and ended with a sync flush so that they're concatenated into one deflate stream.
+// The output only depends on the data and the level, regardless of the threads or how the data is written.
+type parallelGzipWriter struct {
+	w       io.Writer
+	level   int
+	threads int
+	buf     []byte       // The block being filled.
+	dict    []byte       // The end of the last block submitted.
+	pending []*gzipBlock // Blocks being compressed, in order.
+	written []byte       // The data of the last block written, used as the dictionary until the next one is done.
+	crc     uint32       // CRC-32 of the data submitted.
+	size    uint32       // The size of the data submitted, modulo 2^32.
+	started bool         // Whether the header is written.
+	err     error        // The first error writing to w, which is sticky.
+	pool    *sync.Pool   // Pool of *flate.Writer.
+	bufPool *sync.Pool   // Pool of block buffers.
+}
+
+// gzipBlock is a block being compressed.
+type gzipBlock struct {
+	data []byte
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+func newParallelGzipWriter(w io.Writer, level, threads int) (*parallelGzipWriter, error) {
+	// Check the level in advance, so that the workers never fail to create writers.
+	fw, err := flate.NewWriter(io.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	pool := &sync.Pool{}
+	pool.Put(fw)
+	return &parallelGzipWriter{
+		w:       w,
+		level:   level,
+		threads: threads,
+		pool:    pool,
+		bufPool: &sync.Pool{
+			New: func() interface{} {
+				return make([]byte, 0, gzipBlockSize)
+			},
+		},
+	}, nil
+}
+
+func (w *parallelGzipWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(b) > 0 {
+		if w.buf == nil {
+			w.buf = w.bufPool.Get().([]byte)[:0]
+		}
+		n := copy(w.buf[len(w.buf):gzipBlockSize], b)
+		w.buf = w.buf[:len(w.buf)+n]
+		b = b[n:]
+		written += n
+		if len(w.buf) == gzipBlockSize {
+			if err := w.submit(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// submit starts compressing the block filled, after writing the oldest one if too many are pending.
+func (w *parallelGzipWriter) submit() error {
+	if len(w.pending) >= w.threads {
+		if err := w.writeBlock(); err != nil {
+			return err
+		}
+	}
+	block := &gzipBlock{data: w.buf, done: make(chan struct{})}
+	dict := w.dict
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, block.data)
+	w.size += uint32(len(block.data))
+	w.dict = block.data
+	if len(w.dict) > gzipDictSize {
+		w.dict = w.dict[len(w.dict)-gzipDictSize:]
+	}
+	w.buf = nil
+	w.pending = append(w.pending, block)
+	go func() {
+		defer close(block.done)
+		fw := w.pool.Get()
+		if fw == nil {
+			// The level has been checked.
+			fw, _ = flate.NewWriter(nil, w.level)
+		}
+		writer := fw.(*flate.Writer)
+		writer.ResetDict(&block.out, dict)
+		if _, err := writer.Write(block.data); err != nil {
+			block.err = err
+		} else {
+			block.err = writer.Flush()
+		}
+		w.pool.Put(writer)
+	}()
+	return nil
+}
+
+// writeBlock waits for the oldest pending block and writes it.
+func (w *parallelGzipWriter) writeBlock() error {
+	block := w.pending[0]
+	w.pending[0] = nil
+	w.pending = w.pending[1:]
+	<-block.done
+	// The previous block is no longer used as the dictionary.
+	if w.written != nil {
+		w.bufPool.Put(w.written[:0])
+	}
+	w.written = block.data
+	if block.err != nil {
+		return w.fail(block.err)
+	}
+	if !w.started {
+		if _, err := w.w.Write(gzipHeader); err != nil {
+			return w.fail(err)
+		}
+		w.started = true
+	}
+	if _, err := w.w.Write(block.out.Bytes()); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// fail records the error, and waits for the pending blocks to be released.
+func (w *parallelGzipWriter) fail(err error) error {
+	for _, block := range w.pending {
+		<-block.done
+	}
+	w.pending = nil
+	w.err = err
+	return err
+}
+
+// Close writes the remaining data and the trailer, completing the gzip member. It doesn't close the underlying writer.
+func (w *parallelGzipWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) > 0 {
+		if err := w.submit(); err != nil {
+			return err
+		}
+	}
+	for len(w.pending) > 0 {
+		if err := w.writeBlock(); err != nil {
+			return err
+		}
+	}
+	if !w.started {
+		if _, err := w.w.Write(gzipHeader); err != nil {
+			return w.fail(err)
+		}
+	}
+	trailer := make([]byte, len(gzipFinalBlock)+8)
+	copy(trailer, gzipFinalBlock)
+	binary.LittleEndian.PutUint32(trailer[len(gzipFinalBlock):], w.crc)
+	binary.LittleEndian.PutUint32(trailer[len(gzipFinalBlock)+4:], w.size)
+	if _, err := w.w.Write(trailer); err != nil {
+		return w.fail(err)
+	}
+	w.err = errors.New("gzip writer is closed")
+	return nil
+}
+
+// Reset discards the state, and starts a new gzip member written to dst.
+func (w *parallelGzipWriter) Reset(dst io.Writer) {
+	for _, block := range w.pending {
+		<-block.done
+	}
+	*w = parallelGzipWriter{
+		w:       dst,
+		level:   w.level,
+		threads: w.threads,
+		pool:    w.pool,
+		bufPool: w.bufPool,
+	}
+}
+
+// readAheadReader reads from r in a goroutine ahead of the consumer, so that decompression and extraction overlap.
+// Closing it waits for the read in progress, which may be blocked by the source of r.
+type readAheadReader struct {
+	bufs   chan []byte // Buffers read ahead, in order.
+	free   chan []byte // Buffers consumed, to be reused.
+	err    error       // The error ending the reading, available after bufs is closed.
+	buf    []byte      // The buffer being consumed.
+	cur    []byte      // The rest of buf.
+	stopCh chan struct{}
+	stop   sync.Once
+	doneCh chan struct{} // Closed when the goroutine exits.
+}
+
+// newReadAheadReader starts reading r with up to n buffers ahead. The closer of r is closed when the reading ends.
+func newReadAheadReader(r io.Reader, closer io.Closer, n int) *readAheadReader {
+	ra := &readAheadReader{
+		bufs:   make(chan []byte, n),
+		free:   make(chan []byte, n),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go ra.run(r, closer)
+	return ra
+}
+
+func (ra *readAheadReader) run(r io.Reader, closer io.Closer) {
+	defer close(ra.doneCh)
+	defer close(ra.bufs)
+	if closer != nil {
+		defer func() { _ = closer.Close() }()
+	}
+	for {
+		select {
+		case <-ra.stopCh:
+			return
+		default:
+		}
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		default:
+			buf = make([]byte, readAheadSize)
+		}
+		n, err := io.ReadFull(r, buf[:cap(buf)])
+		if n > 0 {
+			select {
+			case ra.bufs <- buf[:n]:
+			case <-ra.stopCh:
+				return
+			}
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			ra.err = err
+			return
+		}
+	}
+}
+
+func (ra *readAheadReader) Read(b []byte) (int, error) {
+	if len(ra.cur) == 0 {
+		if ra.buf != nil {
+			select {
+			case ra.free <- ra.buf:
+			default:
+			}
+		}
+		buf, ok := <-ra.bufs
+		if !ok {
+			ra.buf = nil
+			return 0, ra.err
+		}
+		ra.buf, ra.cur = buf, buf
+	}
+	n := copy(b, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// Close stops reading ahead, and waits for the goroutine to exit, so that r is not read afterwards.
+// It can be called multiple times.
+func (ra *readAheadReader) Close() error {
+	ra.stop.Do(func() { close(ra.stopCh) })
+	<-ra.doneCh
+	return nil
+}
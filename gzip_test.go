@@ -0,0 +1,113 @@
+package vaar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_parallelGzipWriter(t *testing.T) {
+	// Compressible data spanning several blocks, with a partial one in the end.
+	data := make([]byte, 5*gzipBlockSize+12345)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte('a' + rnd.Intn(4))
+	}
+	compress := func(threads int, chunk int) []byte {
+		var buf bytes.Buffer
+		w, err := newParallelGzipWriter(&buf, gzip.DefaultCompression, threads)
+		assert.NilError(t, err)
+		for b := data; len(b) > 0; {
+			n := chunk
+			if n > len(b) {
+				n = len(b)
+			}
+			_, err := w.Write(b[:n])
+			assert.NilError(t, err)
+			b = b[n:]
+		}
+		assert.NilError(t, w.Close())
+		return buf.Bytes()
+	}
+	expected := compress(1, 1<<16)
+	assert.Assert(t, len(expected) < len(data)/2)
+	gr, err := gzip.NewReader(bytes.NewReader(expected))
+	assert.NilError(t, err)
+	decompressed, err := io.ReadAll(gr)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(decompressed, data))
+	// The output is the same regardless of the threads and the writes.
+	for _, threads := range []int{2, 8} {
+		assert.Assert(t, bytes.Equal(compress(threads, 12345), expected), "threads %d", threads)
+	}
+	// An empty stream, and a new member after resetting.
+	var buf bytes.Buffer
+	w, err := newParallelGzipWriter(&buf, gzip.BestSpeed, 4)
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	w.Reset(&buf)
+	_, err = w.Write([]byte("second"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	gr, err = gzip.NewReader(&buf)
+	assert.NilError(t, err)
+	decompressed, err = io.ReadAll(gr)
+	assert.NilError(t, err)
+	assert.Equal(t, string(decompressed), "second")
+	_, err = newParallelGzipWriter(&buf, 42, 1)
+	assert.ErrorContains(t, err, "invalid compression level")
+}
+
+func Test_readAheadReader(t *testing.T) {
+	data := bytes.Repeat([]byte("read ahead "), readAheadSize/4)
+	r := newReadAheadReader(bytes.NewReader(data), nil, 2)
+	read, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(read, data))
+	assert.NilError(t, r.Close())
+	// Closing before reading everything stops the goroutine.
+	r = newReadAheadReader(bytes.NewReader(data), nil, 1)
+	_, err = r.Read(make([]byte, 10))
+	assert.NilError(t, err)
+	assert.NilError(t, r.Close())
+	// Closing again is fine.
+	assert.NilError(t, r.Close())
+	// Closing waits for a blocked read, so that the source is never read after Close returns.
+	br := &blockingReader{entered: make(chan struct{}), release: make(chan struct{})}
+	r = newReadAheadReader(br, nil, 1)
+	<-br.entered
+	closed := make(chan struct{})
+	go func() {
+		_ = r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returns during the read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(br.release)
+	<-closed
+	select {
+	case <-r.doneCh:
+	default:
+		t.Fatal("the goroutine is running after Close")
+	}
+}
+
+// blockingReader blocks in Read until released.
+type blockingReader struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) Read([]byte) (int, error) {
+	close(r.entered)
+	<-r.release
+	return 0, io.EOF
+}
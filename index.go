@@ -0,0 +1,425 @@
+package vaar
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	indexVersion   = 1
+	indexFrameSize = 4 << 20 // 4 MiB of the uncompressed tarball per compression frame.
+)
+
+// Index maps the entries in a tarball to their offsets, so that they can be read without decompressing everything.
+// It's written by a Composer with WithIndex as JSON, and read by Open.
+type Index struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	Size      int64  `json:"size"` // The size of the uncompressed tarball.
+	// Independent compression frames, sorted by offsets. Empty if the tarball is not compressed.
+	Frames  []IndexFrame `json:"frames,omitempty"`
+	Entries []IndexEntry `json:"entries"` // Sorted by offsets.
+}
+
+// IndexFrame is a compression frame, which can be decompressed on its own.
+type IndexFrame struct {
+	Offset    int64 `json:"offset"`     // The offset in the compressed tarball.
+	RawOffset int64 `json:"raw_offset"` // The offset in the uncompressed tarball.
+}
+
+// IndexEntry is an entry in the tarball, with the metadata to serve it as a file system.
+type IndexEntry struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"` // The type flag of the tar header.
+	Linkname string    `json:"linkname,omitempty"`
+	Mode     int64     `json:"mode"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Offset   int64     `json:"offset"` // The offset of the first header block in the uncompressed tarball.
+}
+
+// indexer builds the index of a tarball during tar creation.
+type indexer struct {
+	w     io.Writer    // Where the index is written to.
+	out   *countWriter // The compressed tarball.
+	raw   *countWriter // The uncompressed tarball, under the tar writer.
+	frame frameWriter  // The compression writer, reset for every frame. Nil if not compressed.
+	index Index
+}
+
+// countWriter counts the bytes written.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// frameWriter is a compression writer which can start a new frame after being closed.
+type frameWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// indexEntry records the offset of the entry about to be written, starting a new compression frame if it's time.
+func (c *Composer) indexEntry(header *tar.Header) error {
+	idx := c.index
+	// Pad the previous entry, so that we're at a header block.
+	if err := c.tw.Flush(); err != nil {
+		return err
+	}
+	if idx.frame != nil {
+		lastFrame := idx.index.Frames[len(idx.index.Frames)-1]
+		if idx.raw.n-lastFrame.RawOffset >= indexFrameSize {
+			if err := idx.frame.Close(); err != nil {
+				return fmt.Errorf("failed to end compression frame: %w", err)
+			}
+			idx.frame.Reset(idx.out)
+			idx.index.Frames = append(idx.index.Frames, IndexFrame{Offset: idx.out.n, RawOffset: idx.raw.n})
+		}
+	}
+	idx.index.Entries = append(idx.index.Entries, IndexEntry{
+		Name:     header.Name,
+		Type:     string(header.Typeflag),
+		Linkname: header.Linkname,
+		Mode:     header.Mode,
+		Size:     header.Size,
+		ModTime:  header.ModTime,
+		Offset:   idx.raw.n,
+	})
+	return nil
+}
+
+// writeIndex writes the index after the tarball is completed.
+func (c *Composer) writeIndex() error {
+	idx := c.index
+	idx.index.Size = idx.raw.n
+	if err := json.NewEncoder(idx.w).Encode(&idx.index); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// Archive is a tarball opened with its index for random access. It implements fs.FS.
+type Archive struct {
+	r                  io.ReaderAt
+	index              *Index
+	algorithm          Algorithm
+	compressionThreads int
+	entries            map[string]*IndexEntry // Entries by their cleaned names. The last one wins.
+	children           map[string][]string    // Names of the entries in each directory.
+}
+
+// Open opens a tarball written with WithIndex for random access, with the index read from index.
+// Only the compression frames containing the files read are decompressed.
+func Open(r io.ReaderAt, index io.Reader, options ...Option) (*Archive, error) {
+	idx := &Index{}
+	if err := json.NewDecoder(index).Decode(idx); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if idx.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", idx.Version)
+	}
+	a := &Archive{
+		r:        r,
+		index:    idx,
+		entries:  make(map[string]*IndexEntry),
+		children: make(map[string][]string),
+	}
+	for _, option := range options {
+		if err := option(a); err != nil {
+			return nil, err
+		}
+	}
+	algorithm, err := ParseAlgorithm(idx.Algorithm)
+	if err != nil || algorithm == AutoAlgorithm {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, idx.Algorithm)
+	}
+	a.algorithm = algorithm
+	if a.algorithm != NoAlgorithm && len(idx.Frames) == 0 {
+		return nil, errors.New("invalid index without compression frames")
+	}
+	// Build the directory tree. Parent directories may not be in the tarball.
+	a.entries["."] = &IndexEntry{Name: ".", Type: string(tar.TypeDir), Mode: 0o755}
+	for i := range idx.Entries {
+		entry := &idx.Entries[i]
+		name := path.Clean(strings.TrimLeft(entry.Name, "/"))
+		if len(entry.Type) != 1 {
+			return nil, fmt.Errorf("invalid type of %s in index", entry.Name)
+		}
+		if validateRelPath(name) != nil || name == "." {
+			continue
+		}
+		if _, ok := a.entries[name]; !ok {
+			a.addChild(name)
+		}
+		a.entries[name] = entry
+	}
+	for _, children := range a.children {
+		sort.Strings(children)
+	}
+	return a, nil
+}
+
+// addChild adds the name to its parent directory, adding the parent directory if missing.
+func (a *Archive) addChild(name string) {
+	dir := path.Dir(name)
+	if _, ok := a.entries[dir]; !ok {
+		a.entries[dir] = &IndexEntry{Name: dir, Type: string(tar.TypeDir), Mode: 0o755}
+		a.addChild(dir)
+	}
+	a.children[dir] = append(a.children[dir], path.Base(name))
+}
+
+// Index returns the index of the tarball.
+func (a *Archive) Index() *Index {
+	return a.index
+}
+
+// Open opens a file in the tarball, implementing fs.FS. Directories implement fs.ReadDirFile.
+// Hard links are resolved to their targets, while symlinks are not followed.
+func (a *Archive) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, ok := a.stat(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if info.IsDir() {
+		return &archiveDir{a: a, name: name, info: info}, nil
+	}
+	entry := info.entry
+	file := &archiveFile{info: info}
+	if entry.Type[0] == tar.TypeReg || entry.Type[0] == tar.TypeGNUSparse {
+		r, closer, err := a.reader(entry.Offset)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		tr := tar.NewReader(r)
+		if _, err := tr.Next(); err != nil {
+			if closer != nil {
+				_ = closer.Close()
+			}
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("failed to read header: %w", err)}
+		}
+		file.r, file.closer = tr, closer
+	}
+	return file, nil
+}
+
+// stat returns the file info of an entry by the cleaned name. Hard links have the metadata of their targets.
+func (a *Archive) stat(name string) (indexFileInfo, bool) {
+	entry, ok := a.entries[name]
+	if !ok {
+		return indexFileInfo{}, false
+	}
+	if entry.Type[0] == tar.TypeLink {
+		target, ok := a.entries[path.Clean(strings.TrimLeft(entry.Linkname, "/"))]
+		if !ok || target.Type[0] == tar.TypeLink {
+			return indexFileInfo{}, false
+		}
+		entry = target
+	}
+	return indexFileInfo{entry: entry, name: path.Base(name)}, true
+}
+
+// Extract extracts the file with the name in the tarball to targetPath with the options of Resolve.
+// If it's a directory, everything in it is extracted too, except hard links to files outside it.
+// WithIncremental is ignored, as the deleted files are listed for the whole tarball.
+// Compression options are ignored, as the data is decompressed from the frames containing the files.
+func (a *Archive) Extract(name, targetPath string, options ...Option) error {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	selected := func(entryName string) bool {
+		return name == "." || entryName == name || strings.HasPrefix(entryName, name+"/")
+	}
+	var positions []int
+	found := false
+	for i := range a.index.Entries {
+		entry := &a.index.Entries[i]
+		if !selected(path.Clean(strings.TrimLeft(entry.Name, "/"))) {
+			continue
+		}
+		found = true
+		// Hard links to files outside the selection are skipped, as their targets aren't extracted.
+		if entry.Type[0] == tar.TypeLink && !selected(path.Clean(strings.TrimLeft(entry.Linkname, "/"))) {
+			continue
+		}
+		positions = append(positions, i)
+	}
+	if !found {
+		return &fs.PathError{Op: "extract", Path: name, Err: fs.ErrNotExist}
+	}
+	// The last run may include the files deleted since the snapshot, which mustn't be applied to a selection.
+	options = append(options[:len(options):len(options)], WithCompression(NoAlgorithm), withoutIncremental())
+	// Entries next to each other are extracted in one pass.
+	for start := 0; start < len(positions); {
+		end := start + 1
+		for end < len(positions) && positions[end] == positions[end-1]+1 {
+			end++
+		}
+		offset := a.index.Entries[positions[start]].Offset
+		endOffset := a.index.Size
+		if next := positions[end-1] + 1; next < len(a.index.Entries) {
+			endOffset = a.index.Entries[next].Offset
+		}
+		r, closer, err := a.reader(offset)
+		if err != nil {
+			return err
+		}
+		err = Resolve(io.LimitReader(r, endOffset-offset), targetPath, options...)
+		if closer != nil {
+			_ = closer.Close()
+		}
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// reader returns the uncompressed tarball from the offset, decompressing from the frame containing it.
+func (a *Archive) reader(offset int64) (io.Reader, io.Closer, error) {
+	if a.algorithm == NoAlgorithm {
+		return io.NewSectionReader(a.r, offset, math.MaxInt64-offset), nil, nil
+	}
+	frames := a.index.Frames
+	i := sort.Search(len(frames), func(i int) bool {
+		return frames[i].RawOffset > offset
+	}) - 1
+	if i < 0 {
+		return nil, nil, fmt.Errorf("offset %d is not in any frame", offset)
+	}
+	frame := frames[i]
+	r, closer, err := newDecompressor(
+		io.NewSectionReader(a.r, frame.Offset, math.MaxInt64-frame.Offset), a.algorithm, a.compressionThreads,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, offset-frame.RawOffset); err != nil {
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return nil, nil, fmt.Errorf("failed to decompress frame at %d: %w", frame.Offset, err)
+	}
+	return r, closer, nil
+}
+
+// indexFileInfo implements fs.FileInfo and fs.DirEntry with an entry in the index.
+type indexFileInfo struct {
+	entry *IndexEntry
+	name  string
+}
+
+func (i indexFileInfo) Name() string {
+	return i.name
+}
+
+func (i indexFileInfo) Size() int64 {
+	return i.entry.Size
+}
+
+func (i indexFileInfo) Mode() fs.FileMode {
+	return (&tar.Header{Typeflag: i.entry.Type[0], Mode: i.entry.Mode}).FileInfo().Mode()
+}
+
+func (i indexFileInfo) ModTime() time.Time {
+	return i.entry.ModTime
+}
+
+func (i indexFileInfo) IsDir() bool {
+	return i.entry.Type[0] == tar.TypeDir
+}
+
+func (i indexFileInfo) Sys() interface{} {
+	return i.entry
+}
+
+func (i indexFileInfo) Type() fs.FileMode {
+	return i.Mode().Type()
+}
+
+func (i indexFileInfo) Info() (fs.FileInfo, error) {
+	return i, nil
+}
+
+// archiveFile is a non-directory file opened in an Archive.
+type archiveFile struct {
+	info   indexFileInfo
+	r      io.Reader // The content of a regular file. Nil for other types.
+	closer io.Closer
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *archiveFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		return 0, io.EOF
+	}
+	return f.r.Read(b)
+}
+
+func (f *archiveFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// archiveDir is a directory opened in an Archive.
+type archiveDir struct {
+	a      *Archive
+	name   string
+	info   indexFileInfo
+	offset int // The number of entries read by ReadDir.
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *archiveDir) Close() error {
+	return nil
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	children := d.a.children[d.name][d.offset:]
+	if n > 0 && len(children) > n {
+		children = children[:n]
+	}
+	if n > 0 && len(children) == 0 {
+		return nil, io.EOF
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		info, ok := d.a.stat(path.Join(d.name, child))
+		if !ok {
+			// A hard link to nothing.
+			info = indexFileInfo{entry: d.a.entries[path.Join(d.name, child)], name: child}
+		}
+		entries = append(entries, info)
+	}
+	d.offset += len(children)
+	return entries, nil
+}
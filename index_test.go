@@ -0,0 +1,110 @@
+package vaar
+
+import (
+	"bytes"
+	"fmt"
+	iofs "io/fs"
+	"math/rand"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func TestIndex(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithDir("sub"), fs.WithSymlink("link", "sub")))
+	rnd := rand.New(rand.NewSource(1))
+	contents := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		// Random contents are hardly compressed, so the tarball has several frames.
+		name := fmt.Sprintf("data/file%d", i)
+		if i%4 == 0 {
+			name = fmt.Sprintf("data/sub/file%d", i)
+		}
+		content := make([]byte, 200<<10+i)
+		_, _ = rnd.Read(content)
+		contents[name] = content
+		assert.NilError(t, os.WriteFile(srcDir.Join(name), content, 0o644))
+	}
+	assert.NilError(t, os.Link(srcDir.Join("data", "file1"), srcDir.Join("data", "hardlink")))
+	contents["data/hardlink"] = contents["data/file1"]
+	for _, algorithm := range []Algorithm{NoAlgorithm, GzipAlgorithm, LZ4Algorithm, ZstdAlgorithm} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			var tarball, index bytes.Buffer
+			c, err := NewComposer(&tarball, WithCompression(algorithm), WithIndex(&index))
+			assert.NilError(t, err)
+			assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+			assert.NilError(t, c.Close())
+			// The tarball is still a valid stream.
+			dstDir := fs.NewDir(t, "dst")
+			assert.NilError(t, Resolve(bytes.NewReader(tarball.Bytes()), dstDir.Path(), WithCompression(AutoAlgorithm)))
+			assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.ManifestFromDir(t, srcDir.Join("data"))))
+			a, err := Open(bytes.NewReader(tarball.Bytes()), &index)
+			assert.NilError(t, err)
+			if algorithm != NoAlgorithm {
+				assert.Assert(t, len(a.Index().Frames) > 1, "frames: %d", len(a.Index().Frames))
+			}
+			var names []string
+			for name, content := range contents {
+				names = append(names, name)
+				read, err := iofs.ReadFile(a, name)
+				assert.NilError(t, err)
+				assert.Assert(t, bytes.Equal(read, content), "content of %s", name)
+			}
+			assert.NilError(t, fstest.TestFS(a, names...))
+			_, err = a.Open("data/missing")
+			assert.ErrorIs(t, err, iofs.ErrNotExist)
+			// Extract a directory only.
+			subDir := fs.NewDir(t, "sub")
+			assert.NilError(t, a.Extract("data/sub", subDir.Path()))
+			ops := []fs.PathOp{fs.MatchAnyFileMode}
+			for i := 0; i < 40; i += 4 {
+				name := fmt.Sprintf("file%d", i)
+				ops = append(ops, fs.WithFile(name, string(contents["data/sub/"+name]), fs.MatchAnyFileMode))
+			}
+			assert.Assert(t, fs.Equal(subDir.Join("data"), fs.Expected(
+				t, fs.MatchAnyFileMode, fs.WithDir("sub", ops...),
+			)))
+		})
+	}
+	_, err := Open(bytes.NewReader(nil), bytes.NewReader([]byte(`{"version": 2}`)))
+	assert.ErrorContains(t, err, "unsupported index version")
+}
+
+func TestIndexExtract(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data",
+		fs.WithDir("a", fs.WithFile("file", "content")),
+		fs.WithDir("b", fs.WithFile("file", "content")),
+	))
+	assert.NilError(t, os.Link(srcDir.Join("data", "a", "file"), srcDir.Join("data", "b", "link")))
+	snapshot := NewSnapshot()
+	compose := func() *Archive {
+		var tarball, index bytes.Buffer
+		c, err := NewComposer(&tarball, WithSnapshot(snapshot), WithIndex(&index))
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+		assert.NilError(t, c.Close())
+		a, err := Open(bytes.NewReader(tarball.Bytes()), &index)
+		assert.NilError(t, err)
+		return a
+	}
+	// The hard link to a file outside the directory is skipped.
+	full := compose()
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, full.Extract("data/b", dstDir.Path()))
+	assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.Expected(
+		t, fs.MatchAnyFileMode, fs.WithDir("b", fs.MatchAnyFileMode, fs.WithFile("file", "content", fs.MatchAnyFileMode)),
+	)))
+	// The files deleted elsewhere in the tarball are kept.
+	assert.NilError(t, full.Extract("data/a", dstDir.Path()))
+	assert.NilError(t, os.RemoveAll(srcDir.Join("data", "a")))
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "b", "new"), []byte("new"), 0o644))
+	incremental := compose()
+	assert.NilError(t, incremental.Extract("data/b", dstDir.Path(), WithIncremental()))
+	_, err := os.Stat(dstDir.Join("data", "a", "file"))
+	assert.NilError(t, err)
+	_, err = os.Stat(dstDir.Join("data", "b", "new"))
+	assert.NilError(t, err)
+}
@@ -0,0 +1,56 @@
+package vaar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// ListFunc is the type of the function called by List for each entry in the tarball.
+// The header mustn't be modified.
+type ListFunc func(header *tar.Header) error
+
+// Lister is the context used when the entries of a tarball are listed.
+// It shouldn't be used directly. Use List instead.
+type Lister struct {
+	tr *tar.Reader
+	// Compression fields.
+	algorithm          Algorithm
+	compressionThreads int
+	extraCloser        io.Closer
+}
+
+// List takes a tarball (optionally compressed) from r and calls listFunc for each entry with options.
+// The contents of files are skipped without being read, if r is an uncompressed io.Seeker.
+// An error returned by listFunc stops the listing and is returned directly.
+func List(r io.Reader, listFunc ListFunc, options ...Option) error {
+	l := &Lister{}
+	for _, option := range options {
+		if err := option(l); err != nil {
+			return err
+		}
+	}
+	tr, closer, err := newTarReader(r, l.algorithm, l.compressionThreads)
+	if err != nil {
+		return err
+	}
+	l.tr, l.extraCloser = tr, closer
+	defer func() {
+		if l.extraCloser != nil {
+			_ = l.extraCloser.Close()
+		}
+	}()
+	for {
+		// The tar reader skips the remaining content of the previous file, by seeking if possible.
+		header, err := l.tr.Next()
+		if err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("failed to read from tar stream: %w", err)
+			}
+			return nil
+		}
+		if err := listFunc(header); err != nil {
+			return err
+		}
+	}
+}
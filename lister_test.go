@@ -0,0 +1,38 @@
+package vaar
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func TestList(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content"),
+			fs.WithSymlink("link1", "file1"),
+		),
+	)
+	for _, algorithm := range []Algorithm{NoAlgorithm, GzipAlgorithm} {
+		var buf bytes.Buffer
+		c, err := NewComposer(&buf, WithCompression(algorithm))
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(srcDir.Join("data"), "base"))
+		assert.NilError(t, c.Close())
+		headers := make(map[string]*tar.Header)
+		err = List(bytes.NewReader(buf.Bytes()), func(header *tar.Header) error {
+			headers[header.Name] = header
+			return nil
+		}, WithCompression(AutoAlgorithm))
+		assert.NilError(t, err)
+		assert.Equal(t, len(headers), 3)
+		assert.Equal(t, headers["base/data"].Typeflag, byte(tar.TypeDir))
+		assert.Equal(t, headers["base/data/file1"].Size, int64(7))
+		assert.Assert(t, strings.HasSuffix(headers["base/data/link1"].Linkname, "/file1"))
+	}
+}
@@ -1,6 +1,7 @@
 package vaar
 
 import (
+	"archive/tar"
 	"os"
 	"time"
 )
@@ -9,24 +10,40 @@ type private interface{}
 
 type Option func(i private) error
 
+// Callback is the type of the function called after each entry is processed during tar creation or extraction.
+// The done argument is the total bytes of file contents processed so far, including this entry.
+// The err argument is the error that occurred when processing this entry, if any.
+// Calls are serialized, so it needn't be safe for concurrent use. The header mustn't be modified.
+type Callback func(header *tar.Header, done int64, err error)
+
 type dirent struct {
 	ino  uint64
 	name string
 	typ  byte
 }
 
+// fileID identifies a file on the system, used to detect hard links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
 // Entry represents a file, used in WalkFunc, specialized for tar headers.
 type Entry struct {
 	name     string
 	size     int64
 	mode     os.FileMode
 	modTime  time.Time
+	ctime    time.Time // The status change time, to find changed files in incremental tarballs.
 	sys      interface{}
 	linkname string
 	uid      uint32
 	gid      uint32
-	uname    string
-	gname    string
+	dev      uint64
+	ino      uint64
+	nlink    uint64
+	rdev     uint64
+	names    NameResolver // To look up the names of the owners lazily.
 }
 
 func (e *Entry) Name() string {
@@ -65,10 +82,12 @@ func (e *Entry) GroupID() uint32 {
 	return e.gid
 }
 
+// Owner returns the name of the owner, or an empty string if it's unknown.
 func (e *Entry) Owner() string {
-	return e.uname
+	return e.names.User(e.uid)
 }
 
+// Group returns the name of the group, or an empty string if it's unknown.
 func (e *Entry) Group() string {
-	return e.gname
+	return e.names.Group(e.gid)
 }
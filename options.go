@@ -1,8 +1,19 @@
 package vaar
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
 
-// WithCompression provides the compression algorithm of tar creation and extraction.
+// sourceDateEpochEnv is the environment variable of the reproducible timestamp, see reproducible-builds.org.
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// WithCompression provides the compression algorithm of tar creation, extraction, listing and comparison.
+// AutoAlgorithm and Bzip2Algorithm are not supported in creation.
 func WithCompression(algorithm Algorithm) Option {
 	return func(i private) error {
 		if algorithm.String() == unknownValue {
@@ -13,6 +24,10 @@ func WithCompression(algorithm Algorithm) Option {
 			i.algorithm = algorithm
 		case *Resolver:
 			i.algorithm = algorithm
+		case *Lister:
+			i.algorithm = algorithm
+		case *Differ:
+			i.algorithm = algorithm
 		default:
 			return ErrInapplicableOption
 		}
@@ -35,17 +50,48 @@ func WithLevel(level Level) Option {
 	}
 }
 
-// WithThread specifies the worker number during extraction.
+// WithCompressionThreads specifies the number of threads used by the compression algorithm.
+// Zero means the number of CPUs. It applies to gzip, lz4 and zstd.
+// gzip is compressed in blocks concurrently, with the same output regardless of the threads,
+// and decompressed ahead of the extraction in another goroutine only if n is greater than 1.
+func WithCompressionThreads(n int) Option {
+	return func(i private) error {
+		if n < 0 {
+			return errors.New("compression threads mustn't be negative")
+		}
+		switch i := i.(type) {
+		case *Composer:
+			i.compressionThreads = n
+		case *Resolver:
+			i.compressionThreads = n
+		case *Lister:
+			i.compressionThreads = n
+		case *Differ:
+			i.compressionThreads = n
+		case *Archive:
+			i.compressionThreads = n
+		default:
+			return ErrInapplicableOption
+		}
+		return nil
+	}
+}
+
+// WithThread specifies the worker number during tar creation and extraction.
+// During tar creation, directories are walked with ParallelWalk if it's greater than 1. It's 1 by default.
 func WithThread(n int) Option {
 	return func(i private) error {
 		if n < 1 {
 			return errors.New("thread must be positive")
 		}
-		r, ok := i.(*Resolver)
-		if !ok {
+		switch i := i.(type) {
+		case *Composer:
+			i.thread = n
+		case *Resolver:
+			i.thread = n
+		default:
 			return ErrInapplicableOption
 		}
-		r.thread = n
 		return nil
 	}
 }
@@ -83,6 +129,382 @@ func WithThreshold(size int64) Option {
 	}
 }
 
-// TODO: WithStrip
+// WithStripComponents strips the first n components of paths during extraction, like tar --strip-components.
+// It also applies to the targets of hard links. Files with no more than n components are skipped.
+func WithStripComponents(n int) Option {
+	return func(i private) error {
+		if n < 0 {
+			return errors.New("strip components mustn't be negative")
+		}
+		r, ok := i.(*Resolver)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		r.strip = n
+		return nil
+	}
+}
+
+// WithCallback provides a function called after each entry is processed during tar creation or extraction.
+// It should return quickly, as it blocks the processing.
+func WithCallback(callback Callback) Option {
+	return func(i private) error {
+		if callback == nil {
+			return errors.New("callback mustn't be nil")
+		}
+		switch i := i.(type) {
+		case *Composer:
+			i.callback = callback
+		case *Resolver:
+			i.callback = callback
+		default:
+			return ErrInapplicableOption
+		}
+		return nil
+	}
+}
+
+// WithSkipUnsupported skips unsupported files instead of failing.
+// During tar creation, sockets are skipped. During extraction, entries of unknown types are skipped,
+// and so are device files if there's no permission to create them.
+func WithSkipUnsupported() Option {
+	return func(i private) error {
+		switch i := i.(type) {
+		case *Composer:
+			i.skipUnsupported = true
+		case *Resolver:
+			i.skipUnsupported = true
+		default:
+			return ErrInapplicableOption
+		}
+		return nil
+	}
+}
+
+// WithXattrs preserves extended attributes during tar creation and extraction, including ACLs and file capabilities.
+// They are stored as PAX records with the SCHILY.xattr. prefix, compatible with GNU tar.
+// During extraction, errors caused by lack of support or permission are ignored.
+func WithXattrs() Option {
+	return func(i private) error {
+		switch i := i.(type) {
+		case *Composer:
+			i.xattrs = true
+		case *Resolver:
+			i.xattrs = true
+		default:
+			return ErrInapplicableOption
+		}
+		return nil
+	}
+}
+
+// WithSparse stores the holes in regular files efficiently during tar creation, found with SEEK_DATA and SEEK_HOLE.
+// Files with holes are written in the GNU sparse format 1.0, understood by GNU tar, bsdtar and archive/tar.
+// During extraction, holes in sparse files are always recreated without writing zeros.
+func WithSparse() Option {
+	return func(i private) error {
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.sparse = true
+		return nil
+	}
+}
+
+// WithChecksums hashes the content of each regular file during tar creation, and stores the hex digest
+// as a PAX record named after the algorithm, like VAAR.sha256. Files with holes written by WithSparse are not hashed.
+// Files too big for the copy buffer are read twice, and the creation fails if they change between the reads.
+// During extraction, the content of each file with a digest of the algorithm is verified as it's written,
+// and a mismatch fails with a ChecksumError, removing the file written. Files without the digest are extracted as usual.
+func WithChecksums(checksum Checksum) Option {
+	return func(i private) error {
+		if checksum.String() == unknownValue {
+			return ErrUnknownValue
+		}
+		switch i := i.(type) {
+		case *Composer:
+			i.checksum = checksum
+		case *Resolver:
+			i.checksum = checksum
+		default:
+			return ErrInapplicableOption
+		}
+		return nil
+	}
+}
+
+// WithReproducible makes tar creation reproducible, so that the same tree gives the same tarball on any machine:
+// entries are sorted by their names instead of inodes, owners are zeroed unless given by WithOwner and WithGroup,
+// ID mappings are ignored, access and change times are dropped,
+// and modification times are clamped to SOURCE_DATE_EPOCH from the environment, if it's set.
+// The compression is single-threaded unless WithCompressionThreads is given, which then must be the same.
+// Files with holes found by WithSparse depend on the filesystem, so it shouldn't be used together.
+func WithReproducible() Option {
+	return func(i private) error {
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.reproducible = true
+		if value := os.Getenv(sourceDateEpochEnv); value != "" {
+			sec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", sourceDateEpochEnv, value, err)
+			}
+			c.epoch = time.Unix(sec, 0)
+		}
+		return nil
+	}
+}
+
+// WithOwner records the user with the name and the uid as the owner of all files during tar creation.
+// The name may be empty, in which case only the uid is recorded.
+func WithOwner(name string, uid int) Option {
+	return func(i private) error {
+		if uid < 0 {
+			return errors.New("uid mustn't be negative")
+		}
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.owner.uid, c.owner.uname = uid, name
+		return nil
+	}
+}
+
+// WithGroup records the group with the name and the gid as the group of all files during tar creation.
+// The name may be empty, in which case only the gid is recorded.
+func WithGroup(name string, gid int) Option {
+	return func(i private) error {
+		if gid < 0 {
+			return errors.New("gid mustn't be negative")
+		}
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.owner.gid, c.owner.gname = gid, name
+		return nil
+	}
+}
+
+// WithNumericOwner uses the uid and gid only, ignoring the user and group names.
+// During tar creation, the names are not recorded. During extraction and comparison, they are not looked up,
+// while by default the local user and group with the names in the tarball are preferred to the IDs.
+func WithNumericOwner() Option {
+	return func(i private) error {
+		o, err := getOwnership(i)
+		if err != nil {
+			return err
+		}
+		o.numeric = true
+		return nil
+	}
+}
+
+// WithNameResolver looks up the names of users and groups with r during tar creation.
+// By default, the local ones are looked up and cached in the process. Use NopNameResolver to record the IDs only.
+func WithNameResolver(r NameResolver) Option {
+	return func(i private) error {
+		if r == nil {
+			return errors.New("name resolver mustn't be nil")
+		}
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.names = r
+		return nil
+	}
+}
 
-// TODO: WithCallback
+// WithUIDMappings maps the uids between the tarball and the host, for user namespaces like rootless containers.
+// During tar creation, the uids of files are mapped to the tarball, and the user names are not recorded.
+// During extraction and comparison, the uids in the tarball are mapped to the host, and the user names are ignored.
+// Files with uids not in any mapping cause errors.
+func WithUIDMappings(mappings ...IDMapping) Option {
+	return func(i private) error {
+		if err := validateIDMappings(mappings); err != nil {
+			return err
+		}
+		o, err := getOwnership(i)
+		if err != nil {
+			return err
+		}
+		o.uidMappings = append(o.uidMappings, mappings...)
+		return nil
+	}
+}
+
+// WithGIDMappings is like WithUIDMappings, but maps the gids.
+func WithGIDMappings(mappings ...IDMapping) Option {
+	return func(i private) error {
+		if err := validateIDMappings(mappings); err != nil {
+			return err
+		}
+		o, err := getOwnership(i)
+		if err != nil {
+			return err
+		}
+		o.gidMappings = append(o.gidMappings, mappings...)
+		return nil
+	}
+}
+
+// WithSnapshot creates an incremental tarball against the snapshot, which is updated when the Composer is closed.
+// Files unchanged since the snapshot, by their device, inode, modification time, change time and size,
+// are not archived. Directories are always archived. Files deleted under the added paths are listed in the end.
+// Use NewSnapshot for the first full tarball, and save the snapshot with WriteTo for the next run.
+func WithSnapshot(s *Snapshot) Option {
+	return func(i private) error {
+		if s == nil {
+			return errors.New("snapshot mustn't be nil")
+		}
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.snapshot = s
+		return nil
+	}
+}
+
+// WithIndex writes the index of the tarball to w as JSON when the Composer is closed, to be used with Open.
+// If the tarball is compressed, it's compressed in independent frames of about 4 MiB uncompressed each,
+// so that a file can be read by decompressing the frames containing it only. Files written with TarWriter
+// are not indexed.
+func WithIndex(w io.Writer) Option {
+	return func(i private) error {
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.index = &indexer{w: w}
+		return nil
+	}
+}
+
+// WithUpdate only adds files newer than the ones with the same names in the tarball, like "tar -u".
+// It's only applicable to a Composer created by NewAppendComposer.
+func WithUpdate() Option {
+	return func(i private) error {
+		c, ok := i.(*Composer)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		c.update = true
+		return nil
+	}
+}
+
+// WithIncremental deletes the files listed as deleted in incremental tarballs during extraction.
+// Extract the full tarball and then the incremental ones in order to restore the latest state.
+func WithIncremental() Option {
+	return func(i private) error {
+		res, ok := i.(*Resolver)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		res.incremental = true
+		return nil
+	}
+}
+
+// withoutIncremental undoes WithIncremental, for extracting a part of a tarball.
+func withoutIncremental() Option {
+	return func(i private) error {
+		res, ok := i.(*Resolver)
+		if !ok {
+			return ErrInapplicableOption
+		}
+		res.incremental = false
+		return nil
+	}
+}
+
+// WithExclude skips files matching any of the gitignore-style glob patterns during tar creation, extraction and comparison.
+// The patterns are matched against the paths in the tarball. Directories matching them are not walked at all.
+// See compilePattern for the syntax.
+func WithExclude(patterns ...string) Option {
+	return func(i private) error {
+		f, err := getFilter(i)
+		if err != nil {
+			return err
+		}
+		return f.addExcludes(patterns)
+	}
+}
+
+// WithExcludeFrom is like WithExclude, but reads the patterns from a file, one per line.
+// Empty lines and lines starting with # are ignored.
+func WithExcludeFrom(name string) Option {
+	return func(i private) error {
+		f, err := getFilter(i)
+		if err != nil {
+			return err
+		}
+		patterns, err := readPatternFile(name)
+		if err != nil {
+			return err
+		}
+		return f.addExcludes(patterns)
+	}
+}
+
+// WithInclude only keeps files matching any of the gitignore-style glob patterns during tar creation, extraction and comparison.
+// Directories are always walked to look for files to include, and are kept unless excluded.
+// The patterns are matched against the paths in the tarball. See compilePattern for the syntax.
+func WithInclude(patterns ...string) Option {
+	return func(i private) error {
+		f, err := getFilter(i)
+		if err != nil {
+			return err
+		}
+		return f.addIncludes(patterns)
+	}
+}
+
+// getOwnership returns the ownership of a Composer, a Resolver or a Differ.
+func getOwnership(i private) (*ownership, error) {
+	switch i := i.(type) {
+	case *Composer:
+		return &i.owner, nil
+	case *Resolver:
+		return &i.owner, nil
+	case *Differ:
+		return &i.owner, nil
+	default:
+		return nil, ErrInapplicableOption
+	}
+}
+
+// validateIDMappings checks that the ID mappings are valid.
+func validateIDMappings(mappings []IDMapping) error {
+	for _, m := range mappings {
+		if m.ContainerID < 0 || m.HostID < 0 || m.Size <= 0 {
+			return fmt.Errorf("invalid ID mapping %d:%d:%d", m.ContainerID, m.HostID, m.Size)
+		}
+	}
+	return nil
+}
+
+// getFilter returns the filter of a Composer or a Resolver, creating one if absent.
+func getFilter(i private) (*filter, error) {
+	var f **filter
+	switch i := i.(type) {
+	case *Composer:
+		f = &i.filter
+	case *Resolver:
+		f = &i.filter
+	case *Differ:
+		f = &i.filter
+	default:
+		return nil, ErrInapplicableOption
+	}
+	if *f == nil {
+		*f = &filter{}
+	}
+	return *f, nil
+}
@@ -0,0 +1,152 @@
+package vaar
+
+import (
+	"archive/tar"
+	"fmt"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// IDMapping maps a range of user or group IDs between the tarball and the host, like a line in /proc/self/uid_map.
+// For example, {ContainerID: 0, HostID: 100000, Size: 65536} shifts the IDs of a rootless container.
+type IDMapping struct {
+	ContainerID int // The first ID in the tarball.
+	HostID      int // The first ID on the host.
+	Size        int // The number of IDs mapped.
+}
+
+// ownership is how the owners of files are recorded in tar creation and restored in extraction.
+type ownership struct {
+	// Overriding owners in creation. Negative IDs mean not overridden.
+	uid, gid     int
+	uname, gname string
+	// Ignore the names in the tarball, and don't record them in creation.
+	numeric                  bool
+	uidMappings, gidMappings []IDMapping
+	// IDs of local users and groups looked up by names, or -1 if absent.
+	lock   sync.Mutex
+	users  map[string]int
+	groups map[string]int
+}
+
+func newOwnership() ownership {
+	return ownership{uid: -1, gid: -1}
+}
+
+// archiveOwner sets the owners of a header generated from a local file, mapping the host IDs to the tarball ones.
+// The names of the host are dropped if the IDs are mapped, as they belong to another namespace.
+func (o *ownership) archiveOwner(header *tar.Header) error {
+	if len(o.uidMappings) > 0 {
+		uid, ok := mapID(o.uidMappings, header.Uid, true)
+		if !ok {
+			return fmt.Errorf("uid %d of %s is not mapped", header.Uid, header.Name)
+		}
+		header.Uid, header.Uname = uid, ""
+	}
+	if len(o.gidMappings) > 0 {
+		gid, ok := mapID(o.gidMappings, header.Gid, true)
+		if !ok {
+			return fmt.Errorf("gid %d of %s is not mapped", header.Gid, header.Name)
+		}
+		header.Gid, header.Gname = gid, ""
+	}
+	o.overrideOwner(header)
+	return nil
+}
+
+// overrideOwner sets the overriding owners to a header in creation.
+func (o *ownership) overrideOwner(header *tar.Header) {
+	if o.uid >= 0 {
+		header.Uid, header.Uname = o.uid, o.uname
+	}
+	if o.gid >= 0 {
+		header.Gid, header.Gname = o.gid, o.gname
+	}
+	if o.numeric {
+		header.Uname, header.Gname = "", ""
+	}
+}
+
+// hostOwner returns the IDs on the host of the owners in a header.
+// The names in the header are preferred if they exist locally, unless the ownership is numeric or the IDs are mapped.
+func (o *ownership) hostOwner(header *tar.Header) (uid, gid int, err error) {
+	uid, gid = header.Uid, header.Gid
+	if len(o.uidMappings) > 0 {
+		var ok bool
+		if uid, ok = mapID(o.uidMappings, header.Uid, false); !ok {
+			return 0, 0, fmt.Errorf("uid %d of %s is not mapped", header.Uid, header.Name)
+		}
+	} else if !o.numeric && header.Uname != "" {
+		if id := o.lookup(&o.users, header.Uname, lookupUser); id >= 0 {
+			uid = id
+		}
+	}
+	if len(o.gidMappings) > 0 {
+		var ok bool
+		if gid, ok = mapID(o.gidMappings, header.Gid, false); !ok {
+			return 0, 0, fmt.Errorf("gid %d of %s is not mapped", header.Gid, header.Name)
+		}
+	} else if !o.numeric && header.Gname != "" {
+		if id := o.lookup(&o.groups, header.Gname, lookupGroup); id >= 0 {
+			gid = id
+		}
+	}
+	return uid, gid, nil
+}
+
+// lookup returns the ID of a local user or group by its name in the cache, calling lookupFunc on misses.
+func (o *ownership) lookup(cache *map[string]int, name string, lookupFunc func(string) int) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if *cache == nil {
+		*cache = make(map[string]int)
+	}
+	id, ok := (*cache)[name]
+	if !ok {
+		id = lookupFunc(name)
+		(*cache)[name] = id
+	}
+	return id
+}
+
+// lookupUser returns the uid of a local user, or -1 if it doesn't exist.
+func lookupUser(name string) int {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1
+	}
+	id, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// lookupGroup returns the gid of a local group, or -1 if it doesn't exist.
+func lookupGroup(name string) int {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1
+	}
+	id, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// mapID maps an ID from the host to the tarball if toContainer is set, or the other way around.
+// It reports false if the ID is not in any mapping.
+func mapID(mappings []IDMapping, id int, toContainer bool) (int, bool) {
+	for _, m := range mappings {
+		from, to := m.ContainerID, m.HostID
+		if toContainer {
+			from, to = to, from
+		}
+		if id >= from && id-from < m.Size {
+			return to + id - from, true
+		}
+	}
+	return 0, false
+}
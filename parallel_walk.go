@@ -0,0 +1,352 @@
+package vaar
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	parallelWalkChunkSize  = 256 // The number of entries stated by a task.
+	parallelWalkOpenBudget = 512 // The number of files opened ahead of walkFunc at most.
+)
+
+// parallelWalker is the context of ParallelWalk.
+type parallelWalker struct {
+	threads     int
+	byName      bool                   // Sort the entries of each directory by their names.
+	skipDir     func(path string) bool // Directories skipped by walkFunc, which mustn't be read ahead.
+	walkFunc    WalkFunc
+	tasks       *taskQueue
+	dentBufPool *sync.Pool
+	// A token is taken for each file opened ahead, and returned when the file is passed to walkFunc.
+	openTokens chan struct{}
+}
+
+// walkDir is a directory read ahead by the workers.
+type walkDir struct {
+	path  string
+	fd    int
+	err   error         // The error of opening or reading the directory.
+	ready chan struct{} // Closed when the directory is read, and its entries are scheduled to be stated.
+	dents []*dirent
+	// Results of stating the entries, filled by chunks.
+	entries []*Entry
+	readers []*os.File // Regular files opened ahead, if the budget allows.
+	errs    []error
+	chunks  []chan struct{} // Closed when a chunk of entries is stated.
+}
+
+// ParallelWalk is like Walk, but reads directories, stats and opens files with multiple threads.
+// Zero threads means the number of CPUs.
+// The walkFunc is still called in the calling goroutine, in exactly the same order as Walk, as follows:
+//   1. When a directory is walked, the next sub-directories in it, at most threads of them, are read ahead.
+//   2. The entries of each directory read are stated concurrently in chunks, and regular files are opened.
+//   3. The entries are passed to walkFunc in order, once the chunk containing them is done.
+func ParallelWalk(path string, threads int, walkFunc WalkFunc) error {
+	return parallelWalkPath(path, threads, false, nil, walkFunc)
+}
+
+// parallelWalkPath is ParallelWalk, optionally passing the entries of each directory sorted by their names.
+// Directories for which skipDir returns true are never opened, so walkFunc must return SkipDir for them.
+func parallelWalkPath(path string, threads int, byName bool, skipDir func(path string) bool, walkFunc WalkFunc) error {
+	threads = getConcurrency(threads)
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to calculate the absolute path: %w", err)
+	}
+	dirFd, err := unix.Open(path, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open the walk path: %w", err)
+	}
+	// The root path needs manual walk.
+	var stat unix.Stat_t
+	if err := unix.Fstat(dirFd, &stat); err != nil {
+		_ = unix.Close(dirFd)
+		return fmt.Errorf("failed to stat the walk path: %w", err)
+	}
+	if err := walkFunc(path, parseStat(filepath.Base(path), &stat), nil); err != nil {
+		_ = unix.Close(dirFd)
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	w := &parallelWalker{
+		threads:  threads,
+		byName:   byName,
+		skipDir:  skipDir,
+		walkFunc: walkFunc,
+		tasks:    newTaskQueue(),
+		dentBufPool: &sync.Pool{
+			New: func() interface{} {
+				return make([]byte, dentBufSize)
+			},
+		},
+		openTokens: make(chan struct{}, parallelWalkOpenBudget),
+	}
+	var wg sync.WaitGroup
+	wg.Add(threads)
+	for i := 0; i < threads; i++ {
+		go func() {
+			defer wg.Done()
+			w.tasks.run()
+		}()
+	}
+	// All tasks are done when the walking returns, as it waits for everything read ahead.
+	defer func() {
+		w.tasks.close()
+		wg.Wait()
+	}()
+	root := &walkDir{path: path, fd: dirFd, ready: make(chan struct{})}
+	w.tasks.push(func() { w.readDir(root) })
+	return w.walk(root)
+}
+
+// readDirAhead opens and reads the directory with the name in the parent directory in a worker.
+func (w *parallelWalker) readDirAhead(parentFd int, name, path string) *walkDir {
+	dir := &walkDir{path: path, ready: make(chan struct{})}
+	w.tasks.push(func() {
+		dir.fd, dir.err = unix.Openat(parentFd, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if dir.err != nil {
+			dir.err = fmt.Errorf("failed to open directory %s: %w", path, dir.err)
+			close(dir.ready)
+			return
+		}
+		w.readDir(dir)
+	})
+	return dir
+}
+
+// readDir reads all entries of an opened directory, and schedules the chunks to stat them.
+// The entries are in the same order as Walk.
+func (w *parallelWalker) readDir(dir *walkDir) {
+	defer close(dir.ready)
+	buf := w.dentBufPool.Get().([]byte)
+	defer w.dentBufPool.Put(buf)
+	for {
+		n, err := unix.ReadDirent(dir.fd, buf)
+		if err != nil {
+			_ = unix.Close(dir.fd)
+			dir.err = fmt.Errorf("failed to call getdents64 on %s: %w", dir.path, err)
+			return
+		}
+		if n == 0 {
+			break
+		}
+		dir.dents = append(dir.dents, parseDirentBuf(buf[:n])...)
+	}
+	if w.byName {
+		sortDirentsByName(dir.dents)
+	}
+	dir.entries = make([]*Entry, len(dir.dents))
+	dir.readers = make([]*os.File, len(dir.dents))
+	dir.errs = make([]error, len(dir.dents))
+	for start := 0; start < len(dir.dents); start += parallelWalkChunkSize {
+		end := start + parallelWalkChunkSize
+		if end > len(dir.dents) {
+			end = len(dir.dents)
+		}
+		done := make(chan struct{})
+		dir.chunks = append(dir.chunks, done)
+		start := start
+		w.tasks.push(func() {
+			defer close(done)
+			w.statChunk(dir, start, end)
+		})
+	}
+}
+
+// statChunk stats the entries of a directory in [start, end), and opens the regular files if the budget allows.
+func (w *parallelWalker) statChunk(dir *walkDir, start, end int) {
+	for i := start; i < end; i++ {
+		name := dir.dents[i].name
+		entry, err := StatAt(dir.fd, name)
+		if err != nil {
+			dir.errs[i] = err
+			continue
+		}
+		dir.entries[i] = entry
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		select {
+		case w.openTokens <- struct{}{}:
+		default:
+			// Too many files opened ahead. Leave it to the walking goroutine.
+			continue
+		}
+		file, err := openFile(dir.fd, name, dir.path)
+		if err != nil {
+			<-w.openTokens
+			dir.errs[i] = err
+			continue
+		}
+		dir.readers[i] = file
+	}
+}
+
+// walk passes the entries of a directory read ahead to walkFunc, and walks into the sub-directories.
+func (w *parallelWalker) walk(dir *walkDir) error {
+	<-dir.ready
+	if dir.err != nil {
+		return dir.err
+	}
+	// Sub-directories read ahead, by their indexes in the directory.
+	pending := make(map[int]*walkDir)
+	next := 0 // The index of the next entry to consider reading ahead.
+	defer func() {
+		for _, sub := range pending {
+			w.discard(sub)
+		}
+		w.release(dir)
+	}()
+	for i, dent := range dir.dents {
+		// Keep the next sub-directories read ahead.
+		if next <= i {
+			next = i + 1
+		}
+		for ; next < len(dir.dents) && len(pending) < w.threads; next++ {
+			dent := dir.dents[next]
+			if dent.typ != unix.DT_DIR {
+				continue
+			}
+			if subPath := filepath.Join(dir.path, dent.name); w.skipDir == nil || !w.skipDir(subPath) {
+				pending[next] = w.readDirAhead(dir.fd, dent.name, subPath)
+			}
+		}
+		<-dir.chunks[i/parallelWalkChunkSize]
+		sub, ok := pending[i]
+		delete(pending, i)
+		if dir.errs[i] != nil {
+			if ok {
+				w.discard(sub)
+			}
+			return dir.errs[i]
+		}
+		entry := dir.entries[i]
+		filePath := filepath.Join(dir.path, dent.name)
+		// The reader is passed to walkFunc, which closes it.
+		var reader io.ReadCloser
+		if file := dir.readers[i]; file != nil {
+			dir.readers[i] = nil
+			reader = file
+			<-w.openTokens
+		} else if entry.Mode().IsRegular() {
+			file, err := openFile(dir.fd, dent.name, dir.path)
+			if err != nil {
+				if ok {
+					w.discard(sub)
+				}
+				return err
+			}
+			reader = file
+		}
+		if err := w.walkFunc(filePath, entry, reader); err != nil {
+			if ok {
+				w.discard(sub)
+			}
+			if err == filepath.SkipDir {
+				continue
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			if ok {
+				// It's replaced after being read.
+				w.discard(sub)
+			}
+			continue
+		}
+		if !ok {
+			sub = w.readDirAhead(dir.fd, dent.name, filePath)
+		}
+		if err := w.walk(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard releases a directory read ahead but not walked.
+func (w *parallelWalker) discard(dir *walkDir) {
+	<-dir.ready
+	if dir.err == nil {
+		w.release(dir)
+	}
+}
+
+// release waits for all chunks of a directory, closes the files not passed to walkFunc, and closes the directory.
+func (w *parallelWalker) release(dir *walkDir) {
+	for _, done := range dir.chunks {
+		<-done
+	}
+	for _, file := range dir.readers {
+		if file != nil {
+			_ = file.Close()
+			<-w.openTokens
+		}
+	}
+	_ = unix.Close(dir.fd)
+}
+
+// openFile opens a regular file in an opened directory for reading, and issues a read ahead instruction.
+func openFile(dirFd int, name, dirPath string) (*os.File, error) {
+	fd, err := unix.Openat(dirFd, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s for reading: %w", filepath.Join(dirPath, name), err)
+	}
+	_ = readAhead(fd, adviceSize)
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// taskQueue is an unbounded FIFO queue of tasks, so that pushing a task never blocks the workers.
+type taskQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	tasks  []func()
+	closed bool
+}
+
+func newTaskQueue() *taskQueue {
+	q := &taskQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *taskQueue) push(task func()) {
+	q.lock.Lock()
+	q.tasks = append(q.tasks, task)
+	q.lock.Unlock()
+	q.cond.Signal()
+}
+
+// run runs the tasks in the queue until it's closed.
+func (q *taskQueue) run() {
+	for {
+		q.lock.Lock()
+		for len(q.tasks) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.tasks) == 0 {
+			q.lock.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		q.lock.Unlock()
+		task()
+	}
+}
+
+func (q *taskQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
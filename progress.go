@@ -0,0 +1,118 @@
+package vaar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress aggregates the entries processed during tar creation or extraction, to report the overall progress.
+// Pass its Callback method to WithCallback. It's safe for concurrent use.
+type Progress struct {
+	start time.Time
+	total int64
+	// Counters updated by the callback.
+	lock   sync.Mutex
+	files  int64
+	bytes  int64
+	errors int64
+	// Bytes read from the reader wrapped by Reader, if any. It's used instead of bytes to estimate the time left.
+	read    int64
+	hasRead bool
+}
+
+// ProgressStat is a snapshot of a Progress.
+type ProgressStat struct {
+	Files          int64         // The number of processed entries.
+	Bytes          int64         // The bytes of processed file contents.
+	Errors         int64         // The number of entries failed to process.
+	Elapsed        time.Duration // The time since the Progress is created.
+	FilesPerSecond float64
+	BytesPerSecond float64
+	ETA            time.Duration // The estimated time left. It's zero if the total is unknown.
+}
+
+// progressReader counts the bytes read from a reader for a Progress.
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+// NewProgress creates a Progress starting from now.
+// The total argument is the expected bytes to process, used to estimate the time left. Zero means unknown.
+// By default, the total is compared with the bytes of file contents. If Reader is used, the bytes read from it are
+// compared instead, which is useful to take the size of a compressed tarball as the total.
+func NewProgress(total int64) *Progress {
+	return &Progress{
+		start: time.Now(),
+		total: total,
+	}
+}
+
+// Callback updates the progress with a processed entry. It implements Callback.
+func (p *Progress) Callback(_ *tar.Header, done int64, err error) {
+	p.lock.Lock()
+	p.files++
+	p.bytes = done
+	if err != nil {
+		p.errors++
+	}
+	p.lock.Unlock()
+}
+
+// Reader wraps r, so that the bytes read from it are used to estimate the time left.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	p.lock.Lock()
+	p.hasRead = true
+	p.lock.Unlock()
+	return &progressReader{r: r, p: p}
+}
+
+// Stat returns a snapshot of the progress.
+func (p *Progress) Stat() ProgressStat {
+	p.lock.Lock()
+	stat := ProgressStat{
+		Files:   p.files,
+		Bytes:   p.bytes,
+		Errors:  p.errors,
+		Elapsed: time.Since(p.start),
+	}
+	position := p.bytes
+	if p.hasRead {
+		position = atomic.LoadInt64(&p.read)
+	}
+	p.lock.Unlock()
+	seconds := stat.Elapsed.Seconds()
+	if seconds > 0 {
+		stat.FilesPerSecond = float64(stat.Files) / seconds
+		stat.BytesPerSecond = float64(stat.Bytes) / seconds
+	}
+	if p.total > 0 && position > 0 && position < p.total {
+		stat.ETA = time.Duration(float64(stat.Elapsed) * float64(p.total-position) / float64(position))
+	}
+	return stat
+}
+
+// String formats the snapshot in a human-readable way.
+func (s ProgressStat) String() string {
+	str := fmt.Sprintf(
+		"%d files, %.1f MB, %.1f files/s, %.1f MB/s",
+		s.Files, float64(s.Bytes)/1e6, s.FilesPerSecond, s.BytesPerSecond/1e6,
+	)
+	if s.Errors > 0 {
+		str += fmt.Sprintf(", %d errors", s.Errors)
+	}
+	if s.ETA > 0 {
+		str += ", ETA " + s.ETA.Round(time.Second).String()
+	}
+	return str
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(&r.p.read, int64(n))
+	return n, err
+}
@@ -2,16 +2,21 @@ package vaar
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
-	"github.com/klauspost/compress/gzip"
 	"github.com/pierrec/lz4/v4"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -23,14 +28,27 @@ const (
 // Resolver is the context used when a tarball is being extracted.
 // It shouldn't be used directly. Use Resolve instead.
 type Resolver struct {
+	ctx        context.Context
 	tr         *tar.Reader
 	targetPath string
+	targetFd   int // The opened target directory, beneath which all paths are resolved.
 	thread     int
 	readAhead  int
 	threshold  int64
+	strip      int
+	callback   Callback
+	filter     *filter
+	// Skip entries of unknown types and device files without permission.
+	skipUnsupported bool
+	xattrs          bool
+	owner           ownership
+	checksum        Checksum
+	// Delete the files listed in incremental tarballs.
+	incremental bool
 	// Compression fields.
-	algorithm   Algorithm
-	extraCloser io.Closer
+	algorithm          Algorithm
+	compressionThreads int
+	extraCloser        io.Closer
 	// Runtime status.
 	bufferCh  chan *extractOperation // Buffered files are sent here.
 	errCh     chan error
@@ -38,31 +56,59 @@ type Resolver struct {
 	closeLock sync.Mutex
 	wg        sync.WaitGroup
 	bufPool   sync.Pool // To reuse files buffers.
+	// Buffered regular files not written yet. Hard links to them must wait until they are done.
+	pending     map[string]chan struct{}
+	pendingLock sync.Mutex
+	// Directories extracted, whose metadata is restored in the end.
+	dirs     map[string]*tar.Header
+	dirsLock sync.Mutex
+	// Bytes of file contents written, reported to the callback.
+	done         int64
+	callbackLock sync.Mutex
 }
 
 // extractOperation is an unfinished extract operation, either buffered or synchronous.
 type extractOperation struct {
 	header *tar.Header
 	reader io.Reader
+	done   chan struct{} // Closed when a buffered regular file is written, successfully or not.
 }
 
 // Resolve takes a tarball (optionally compressed) from r and extracts it to targetPath with options.
 // The leading slashes of the files are trimmed and path traversal is forbidden.
+// The metadata of directories is restored after all files are extracted.
 func Resolve(r io.Reader, targetPath string, options ...Option) error {
+	return ResolveContext(context.Background(), r, targetPath, options...)
+}
+
+// ResolveContext is like Resolve, but stops reading and writing when ctx is done.
+// In this case, the error of ctx is returned, wrapped with the file being extracted.
+func ResolveContext(ctx context.Context, r io.Reader, targetPath string, options ...Option) error {
 	res := &Resolver{
+		ctx:        ctx,
 		targetPath: targetPath,
 		thread:     resolveDefaultThread,
 		readAhead:  resolveDefaultReadAhead,
 		threshold:  resolveDefaultThreshold,
+		owner:      newOwnership(),
 	}
 	for _, option := range options {
 		if err := option(res); err != nil {
 			return err
 		}
 	}
-	if err := res.initReader(r); err != nil {
+	if err := res.initReader(newContextReader(ctx, r)); err != nil {
+		return err
+	}
+	defer func() {
+		if res.extraCloser != nil {
+			_ = res.extraCloser.Close()
+		}
+	}()
+	if err := res.openTarget(); err != nil {
 		return err
 	}
+	defer func() { _ = unix.Close(res.targetFd) }()
 	res.initRuntime()
 	for i := 0; i < res.thread; i++ {
 		go res.writeBuffer()
@@ -73,29 +119,101 @@ func Resolve(r io.Reader, targetPath string, options ...Option) error {
 		return err
 	}
 	close(res.errCh)
-	return <-res.errCh
+	if err := <-res.errCh; err != nil {
+		return err
+	}
+	return res.restoreDirs()
 }
 
 func (res *Resolver) initReader(r io.Reader) error {
-	switch res.algorithm {
-	case NoAlgorithm:
-	case GzipAlgorithm:
-		gr, err := gzip.NewReader(r)
+	tr, closer, err := newTarReader(r, res.algorithm, res.compressionThreads)
+	if err != nil {
+		return err
+	}
+	res.tr, res.extraCloser = tr, closer
+	return nil
+}
+
+// newTarReader creates a tar reader on r decompressed with the algorithm.
+// The returned closer, if not nil, must be closed to release resources after reading.
+func newTarReader(r io.Reader, algorithm Algorithm, threads int) (*tar.Reader, io.Closer, error) {
+	if algorithm == AutoAlgorithm {
+		detected, dr, err := detectAlgorithm(r)
 		if err != nil {
-			return fmt.Errorf("failed to create gzip reader: %w", err)
+			return nil, nil, err
+		}
+		r, algorithm = dr, detected
+	}
+	r, closer, err := newDecompressor(r, algorithm, threads)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tar.NewReader(r), closer, nil
+}
+
+// newDecompressor decompresses r with the algorithm, which mustn't be AutoAlgorithm.
+// Concatenated frames or members are read as a whole stream.
+// The returned closer, if not nil, must be closed to release resources after reading.
+func newDecompressor(r io.Reader, algorithm Algorithm, threads int) (io.Reader, io.Closer, error) {
+	if algorithm == NoAlgorithm {
+		return r, nil, nil
+	}
+	c := getCodec(algorithm)
+	if c == nil {
+		return nil, nil, fmt.Errorf("%w: %v in extraction", ErrUnsupportedAlgorithm, algorithm)
+	}
+	rc, err := c.newReader(r, getConcurrency(threads))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create %s reader: %w", c.name, err)
+	}
+	if c.readAhead && threads > 1 {
+		// Decompression is sequential, but it can run ahead of the extraction. It's opt-in, not with the default threads,
+		// as closing waits for the read in progress, which may block as long as r does.
+		ra := newReadAheadReader(rc, rc, readAheadN)
+		return ra, ra, nil
+	}
+	return rc, rc, nil
+}
+
+// lz4FramesReader reads concatenated lz4 frames, as lz4.Reader stops at the end of the first one.
+type lz4FramesReader struct {
+	lr        *lz4.Reader
+	src       *bufio.Reader
+	frameDone bool
+}
+
+func (r *lz4FramesReader) Read(b []byte) (int, error) {
+	for {
+		if r.frameDone {
+			if _, err := r.src.Peek(1); err != nil {
+				// No more frames.
+				return 0, io.EOF
+			}
+			r.lr.Reset(r.src)
+			r.frameDone = false
 		}
-		r = gr
-		res.extraCloser = gr
-	case LZ4Algorithm:
-		lr := lz4.NewReader(r)
-		if err := lr.Apply(lz4.ConcurrencyOption(-1)); err != nil {
-			return fmt.Errorf("failed to apply lz4 options: %w", err)
+		n, err := r.lr.Read(b)
+		if err == io.EOF {
+			r.frameDone = true
+			if n == 0 {
+				continue
+			}
+			err = nil
 		}
-		r = lr
-	default:
-		return ErrUnsupportedAlgorithm
+		return n, err
+	}
+}
+
+// openTarget creates the target directory if missing, and opens it as the root of all extracted files.
+func (res *Resolver) openTarget() error {
+	if err := os.MkdirAll(res.targetPath, 0o777); err != nil {
+		return fmt.Errorf("failed to create target directory %s: %w", res.targetPath, err)
+	}
+	fd, err := unix.Open(res.targetPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open target directory %s: %w", res.targetPath, err)
 	}
-	res.tr = tar.NewReader(r)
+	res.targetFd = fd
 	return nil
 }
 
@@ -108,6 +226,8 @@ func (res *Resolver) initRuntime() {
 			return bytes.NewBuffer(make([]byte, 0, res.threshold))
 		},
 	}
+	res.pending = make(map[string]chan struct{})
+	res.dirs = make(map[string]*tar.Header)
 	res.wg.Add(res.thread)
 }
 
@@ -124,8 +244,27 @@ func (res *Resolver) readStream() error {
 			}
 			return nil
 		}
+		if err := res.ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted when extracting %s: %w", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			// Global PAX headers carry no files, but may list the files deleted in an incremental tarball.
+			if deleted, ok := header.PAXRecords[paxDeleted]; ok && res.incremental {
+				if err := res.deleteFiles(strings.Split(deleted, "\x00")); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if res.strip > 0 && !stripHeader(header, res.strip) {
+			// Nothing left after stripping. The content, if any, is skipped by the tar reader.
+			continue
+		}
+		if res.filter != nil && res.filter.excluded(header.Name, header.Typeflag == tar.TypeDir) {
+			continue
+		}
 		op := &extractOperation{header: header}
-		if header.Typeflag == tar.TypeReg {
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse {
 			// This is a regular file. We need to decide whether to buffer its content and write it asynchronously.
 			if header.Size > res.threshold {
 				// Too big to be buffered. Write it in this thread.
@@ -140,22 +279,50 @@ func (res *Resolver) readStream() error {
 				return fmt.Errorf("failed to read %s from tar stream: %w", header.Name, err)
 			}
 			op.reader = buf
+			op.done = res.markPending(header.Name)
 		}
 		select {
 		case res.bufferCh <- op:
 		case <-res.closeCh:
 			return nil
+		case <-res.ctx.Done():
+			return fmt.Errorf("interrupted when extracting %s: %w", header.Name, res.ctx.Err())
 		}
 	}
 }
 
+// stripHeader strips the name and the hard link target of the header by n components.
+// It reports false if the header should be skipped.
+func stripHeader(header *tar.Header, n int) bool {
+	header.Name = stripComponents(header.Name, n)
+	if header.Name == "" {
+		return false
+	}
+	if header.Typeflag == tar.TypeLink {
+		header.Linkname = stripComponents(header.Linkname, n)
+		if header.Linkname == "" {
+			return false
+		}
+	}
+	return true
+}
+
 // writeBuffer writes all buffered files from the channel.
 // It returns when all files are drained or an error occurred.
 func (res *Resolver) writeBuffer() {
 	defer res.wg.Done()
 	for op := range res.bufferCh {
 		header, reader := op.header, op.reader
-		if err := res.writeFile(header, reader); err != nil {
+		err := res.ctx.Err()
+		if err != nil {
+			err = fmt.Errorf("interrupted when extracting %s: %w", header.Name, err)
+		} else {
+			err = res.writeFile(header, reader)
+		}
+		if op.done != nil {
+			res.unmarkPending(header.Name, op.done)
+		}
+		if err != nil {
 			res.errCh <- err
 			res.cancel()
 			return
@@ -169,68 +336,376 @@ func (res *Resolver) writeBuffer() {
 }
 
 // writeFile performs the actual write operation, either the synchronous ones and the asynchronous ones.
-// Currently, we support directories, regular files, symlinks and hard links.
-func (res *Resolver) writeFile(header *tar.Header, r io.Reader) error {
+// Currently, we support directories, regular files, symlinks, hard links, device files and named pipes.
+// Hard links are created after their targets are written, as the targets may be buffered in other workers.
+func (res *Resolver) writeFile(header *tar.Header, r io.Reader) (err error) {
+	var n int64
+	if res.callback != nil {
+		defer func() {
+			res.callbackLock.Lock()
+			res.done += n
+			res.callback(header, res.done, err)
+			res.callbackLock.Unlock()
+		}()
+	}
 	name := strings.TrimLeft(header.Name, "/") // Leading slashes are trimmed to make the paths relative.
 	if err := validateRelPath(name); err != nil {
-		return err
+		return &UnsafePathError{Name: header.Name, Err: err}
 	}
+	// All paths are resolved beneath the target directory without following symlinks,
+	// so that a symlink extracted before cannot redirect the following entries outside.
+	name = path.Clean(name)
 	targetPath := filepath.Join(res.targetPath, name)
-	mode := os.FileMode(header.Mode)
-	accessTime, modTime := header.AccessTime, header.ModTime
-	switch header.Typeflag {
-	case tar.TypeDir:
+	mode := uint32(header.Mode) & 0o7777
+	uid, gid, err := res.owner.hostOwner(header)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeDir {
 		// Directories are created with the default permission determined by umask.
-		if err := os.MkdirAll(targetPath, 0o777); err != nil {
+		fd, err := res.openDir(name)
+		if err != nil {
 			return err
 		}
-		// We only chmod here to make sure it's eventually the same with the record in the tarball.
-		// All errors from chmod are ignored as some filesystems don't support this.
-		// FIXME: if the recorded permission denies write, subsequent writes in this directory fail.
-		_ = os.Chmod(targetPath, mode)
-		_ = os.Chown(targetPath, header.Uid, header.Gid)
+		_ = unix.Close(fd)
+		// The metadata is restored after all files are written. Otherwise, a read-only directory denies the files
+		// in it, and its modification time is changed by them.
+		res.dirsLock.Lock()
+		res.dirs[name] = header
+		res.dirsLock.Unlock()
+		return nil
+	}
+	dirFd, base, err := res.openParent(name, true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unix.Close(dirFd) }()
+	switch header.Typeflag {
 	case tar.TypeLink:
-		// FIXME: we should try to support real hard links. As the target may not exist yet, we create symlinks instead.
-		fallthrough
-	case tar.TypeSymlink:
-		if err := os.MkdirAll(filepath.Dir(targetPath), 0o777); err != nil {
-			return err
+		linkName := strings.TrimLeft(header.Linkname, "/")
+		if err := validateRelPath(linkName); err != nil {
+			return fmt.Errorf("invalid hard link target %s: %w", header.Linkname, &UnsafePathError{Name: header.Linkname, Err: err})
+		}
+		linkName = path.Clean(linkName)
+		// The target may be still being written by a worker.
+		if err := res.waitPending(linkName); err != nil {
+			return fmt.Errorf("interrupted when extracting %s: %w", name, err)
+		}
+		linkDirFd, linkBase, err := res.openParent(linkName, false)
+		if err != nil {
+			return fmt.Errorf("invalid hard link target %s: %w", header.Linkname, err)
+		}
+		defer func() { _ = unix.Close(linkDirFd) }()
+		// Symlinks are never followed by linkat without AT_SYMLINK_FOLLOW.
+		if err := unix.Linkat(linkDirFd, linkBase, dirFd, base, 0); err != nil {
+			if errors.Is(err, unix.EEXIST) {
+				_ = unlinkat(dirFd, base)
+				err = unix.Linkat(linkDirFd, linkBase, dirFd, base, 0)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to create hard link %s to %s: %w", targetPath, linkName, err)
+			}
 		}
+	case tar.TypeSymlink:
 		linkTarget := header.Linkname
-		if err := os.Symlink(linkTarget, targetPath); err != nil {
-			if os.IsExist(err) {
-				_ = os.Remove(targetPath)
-				err = os.Symlink(linkTarget, targetPath)
+		if err := unix.Symlinkat(linkTarget, dirFd, base); err != nil {
+			if errors.Is(err, unix.EEXIST) {
+				_ = unlinkat(dirFd, base)
+				err = unix.Symlinkat(linkTarget, dirFd, base)
 			}
 			if err != nil {
 				return fmt.Errorf("failed to create symlink %s to %s: %w", targetPath, linkTarget, err)
 			}
 		}
-		_ = chmodSymlink(linkTarget, mode)
-	case tar.TypeReg:
-		if err := os.MkdirAll(filepath.Dir(targetPath), 0o777); err != nil {
+		_ = unix.Fchownat(dirFd, base, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+		_ = chmodSymlink(dirFd, base, mode)
+		if err := res.restoreXattrsAt(header, dirFd, base); err != nil {
 			return err
 		}
-		file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	case tar.TypeReg, tar.TypeGNUSparse:
+		// An existing symlink is replaced instead of being written through.
+		flags := unix.O_CREAT | unix.O_WRONLY | unix.O_TRUNC | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		fd, err := unix.Openat(dirFd, base, flags, mode&0o777)
+		if errors.Is(err, unix.ELOOP) {
+			_ = unlinkat(dirFd, base)
+			fd, err = unix.Openat(dirFd, base, flags, mode&0o777)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to create file %s: %w", targetPath, err)
 		}
-		// FIXME: we should use a copy buffer, but os.File cannot use it.
-		if _, err := io.Copy(file, r); err != nil {
+		file := os.NewFile(uintptr(fd), targetPath)
+		cr := newChecksumReader(header, r, res.checksum)
+		if cr != nil {
+			r = cr
+		}
+		if isSparse(header) {
+			// Holes are read as zeros, which are skipped to recreate the holes.
+			n, err = copySparse(file, r, header.Size)
+		} else {
+			// FIXME: we should use a copy buffer, but os.File cannot use it.
+			n, err = io.Copy(file, r)
+		}
+		if err != nil {
 			_ = file.Close()
 			return fmt.Errorf("failed to write file %s: %w", name, err)
 		}
-		_ = file.Chmod(mode)
-		_ = file.Chown(header.Uid, header.Gid)
+		if cr != nil {
+			if err := cr.verify(name); err != nil {
+				// The corrupted content is never left with the name.
+				_ = file.Close()
+				_ = unix.Unlinkat(dirFd, base, 0)
+				return err
+			}
+		}
+		// Chown goes first, as it may clear the setuid and setgid bits.
+		_ = unix.Fchown(fd, uid, gid)
+		_ = unix.Fchmod(fd, mode)
+		// Extended attributes are restored after chown, which clears file capabilities.
+		if err := res.restoreXattrs(header, fd); err != nil {
+			_ = file.Close()
+			return err
+		}
 		_ = file.Close()
-		// All errors from chtimes are ignored as some filesystems don't support this.
-		_ = os.Chtimes(targetPath, accessTime, modTime)
+		// All errors from utimensat are ignored as some filesystems don't support this.
+		_ = unix.UtimesNanoAt(dirFd, base, headerTimes(header), unix.AT_SYMLINK_NOFOLLOW)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := mknod(dirFd, base, targetPath, header); err != nil {
+			if errors.Is(err, unix.EEXIST) {
+				_ = unlinkat(dirFd, base)
+				err = mknod(dirFd, base, targetPath, header)
+			}
+			if err != nil {
+				if res.skipUnsupported && errors.Is(err, unix.EPERM) {
+					return nil
+				}
+				return fmt.Errorf("failed to create special file %s: %w", targetPath, err)
+			}
+		}
+		_ = unix.Fchownat(dirFd, base, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+		_ = unix.Fchmodat(dirFd, base, mode, 0)
+		if err := res.restoreXattrsAt(header, dirFd, base); err != nil {
+			return err
+		}
+		_ = unix.UtimesNanoAt(dirFd, base, headerTimes(header), unix.AT_SYMLINK_NOFOLLOW)
 	default:
+		if res.skipUnsupported {
+			return nil
+		}
 		return fmt.Errorf("unsupported file type %s", string(header.Typeflag))
 	}
 	return nil
 }
 
+// deleteFiles deletes the files listed in an incremental tarball, which are never in the same tarball.
+// Files are deleted before their parent directories. Directories not empty are left, as they have untracked files.
+func (res *Resolver) deleteFiles(names []string) error {
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		if err := res.ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted when deleting %s: %w", name, err)
+		}
+		if res.strip > 0 {
+			if name = stripComponents(name, res.strip); name == "" {
+				continue
+			}
+		}
+		if res.filter != nil && res.filter.excluded(name, false) {
+			continue
+		}
+		name = strings.TrimLeft(name, "/")
+		if err := validateRelPath(name); err != nil {
+			return &UnsafePathError{Name: name, Err: err}
+		}
+		name = path.Clean(name)
+		dirFd, base, err := res.openParent(name, false)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+				continue
+			}
+			return err
+		}
+		err = unix.Unlinkat(dirFd, base, 0)
+		if errors.Is(err, unix.EISDIR) || errors.Is(err, unix.EPERM) {
+			err = unix.Unlinkat(dirFd, base, unix.AT_REMOVEDIR)
+		}
+		_ = unix.Close(dirFd)
+		if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to delete %s: %w", filepath.Join(res.targetPath, name), err)
+		}
+	}
+	return nil
+}
+
+// restoreDirs restores the mode, owner, extended attributes and times of the extracted directories, like GNU tar.
+// The deepest directories go first, so that a read-only parent doesn't deny its children.
+func (res *Resolver) restoreDirs() error {
+	names := make([]string, 0, len(res.dirs))
+	for name := range res.dirs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		di, dj := pathDepth(names[i]), pathDepth(names[j])
+		if di != dj {
+			return di > dj
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if err := res.ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted when restoring directory %s: %w", name, err)
+		}
+		header := res.dirs[name]
+		fd, err := openBeneath(res.targetFd, name, false)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) || errors.Is(err, errSymlinkComponent) {
+				// The directory is replaced by a later entry.
+				continue
+			}
+			return fmt.Errorf("failed to open directory %s: %w", name, err)
+		}
+		// All errors are ignored as some filesystems don't support these.
+		// The owners have been checked when the directory is created.
+		uid, gid, _ := res.owner.hostOwner(header)
+		_ = unix.Fchown(fd, uid, gid)
+		_ = unix.Fchmod(fd, uint32(header.Mode)&0o7777)
+		if err := res.restoreXattrs(header, fd); err != nil {
+			_ = unix.Close(fd)
+			return err
+		}
+		_ = unix.UtimesNanoAt(fd, ".", headerTimes(header), 0)
+		_ = unix.Close(fd)
+	}
+	return nil
+}
+
+// pathDepth returns the number of components in a cleaned relative path. The depth of "." is 0.
+func pathDepth(name string) int {
+	if name == "." {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// openDir opens the directory with the name beneath the target path, creating it and its parents if missing.
+func (res *Resolver) openDir(name string) (int, error) {
+	fd, err := openBeneath(res.targetFd, name, true)
+	if err != nil {
+		if errors.Is(err, errSymlinkComponent) {
+			return -1, &UnsafePathError{Name: name, Err: err}
+		}
+		return -1, fmt.Errorf("failed to create directory %s: %w", name, err)
+	}
+	return fd, nil
+}
+
+// openParent opens the parent directory of the name beneath the target path, and returns it with the base name.
+// If create is true, the parent directories are created if missing.
+func (res *Resolver) openParent(name string, create bool) (int, string, error) {
+	fd, err := openBeneath(res.targetFd, path.Dir(name), create)
+	if err != nil {
+		if errors.Is(err, errSymlinkComponent) {
+			return -1, "", &UnsafePathError{Name: name, Err: err}
+		}
+		return -1, "", fmt.Errorf("failed to open parent directory of %s: %w", name, err)
+	}
+	return fd, path.Base(name), nil
+}
+
+// restoreXattrs restores the extended attributes recorded in the header to the opened file, if enabled.
+func (res *Resolver) restoreXattrs(header *tar.Header, fd int) error {
+	if !res.xattrs {
+		return nil
+	}
+	return restoreXattrs(header, func(attr string, data []byte) error {
+		return unix.Fsetxattr(fd, attr, data, 0)
+	})
+}
+
+// restoreXattrsAt is like restoreXattrs, but for a symlink or a special file with the name in dirFd,
+// which cannot be opened for reading. It's opened without following symlinks, instead of being resolved by the path
+// again, so that it cannot be replaced by a symlink leading out of the target directory.
+func (res *Resolver) restoreXattrsAt(header *tar.Header, dirFd int, name string) error {
+	if !res.xattrs || !hasXattrs(header) {
+		return nil
+	}
+	fd, err := openNoFollow(dirFd, name)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for extended attributes: %w", header.Name, err)
+	}
+	defer func() { _ = unix.Close(fd) }()
+	return restoreXattrs(header, func(attr string, data []byte) error {
+		return setXattrNoFollow(fd, attr, data)
+	})
+}
+
+// mknod creates a device file or a named pipe recorded in the header, with the name in dirFd.
+// The path argument is the full path to the same file, used on systems without mknodat.
+func mknod(dirFd int, name, path string, header *tar.Header) error {
+	perm := uint32(header.Mode & 0o777)
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock:
+		mode := uint32(unix.S_IFCHR)
+		if header.Typeflag == tar.TypeBlock {
+			mode = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		return mknodat(dirFd, name, path, mode|perm, int(dev))
+	default:
+		return mknodat(dirFd, name, path, unix.S_IFIFO|perm, 0)
+	}
+}
+
+// headerTimes returns the access time and the modification time of the header for utimensat.
+// The access time is only recorded in PAX and GNU formats. If it's missing, the modification time is used.
+func headerTimes(header *tar.Header) []unix.Timespec {
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+	return []unix.Timespec{
+		unix.NsecToTimespec(accessTime.UnixNano()),
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+}
+
+// markPending records a buffered regular file being sent to workers, and returns a channel to close when it's done.
+func (res *Resolver) markPending(name string) chan struct{} {
+	done := make(chan struct{})
+	res.pendingLock.Lock()
+	res.pending[path.Clean(strings.TrimLeft(name, "/"))] = done
+	res.pendingLock.Unlock()
+	return done
+}
+
+// unmarkPending removes a written file from the pending list, and wakes up hard links waiting for it.
+func (res *Resolver) unmarkPending(name string, done chan struct{}) {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	res.pendingLock.Lock()
+	// The same name may appear again in the tarball, and we only remove our own record.
+	if res.pending[name] == done {
+		delete(res.pending, name)
+	}
+	res.pendingLock.Unlock()
+	close(done)
+}
+
+// waitPending waits until the file with the name is written, if it's buffered and not written yet.
+// It returns the error of the context if it's done before that.
+func (res *Resolver) waitPending(name string) error {
+	res.pendingLock.Lock()
+	done, ok := res.pending[path.Clean(name)]
+	res.pendingLock.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-res.ctx.Done():
+		return res.ctx.Err()
+	}
+}
+
 func (res *Resolver) cancel() {
 	res.closeLock.Lock()
 	select {
@@ -0,0 +1,777 @@
+package vaar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/fs"
+)
+
+func TestHardLinks(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "hard linked"),
+			fs.WithFile("file2", "not linked"),
+			fs.WithDir("sub"),
+		),
+	)
+	assert.NilError(t, os.Link(srcDir.Join("data", "file1"), srcDir.Join("data", "sub", "link1")))
+	assert.NilError(t, os.Link(srcDir.Join("data", "file1"), srcDir.Join("data", "link2")))
+	dstDir := roundTrip(t, srcDir.Join("data"), nil, WithThread(8))
+	var stat1, stat2, stat3 unix.Stat_t
+	assert.NilError(t, unix.Lstat(dstDir.Join("data", "file1"), &stat1))
+	assert.NilError(t, unix.Lstat(dstDir.Join("data", "sub", "link1"), &stat2))
+	assert.NilError(t, unix.Lstat(dstDir.Join("data", "link2"), &stat3))
+	assert.Equal(t, stat1.Ino, stat2.Ino)
+	assert.Equal(t, stat1.Ino, stat3.Ino)
+	assert.Equal(t, uint64(stat1.Nlink), uint64(3))
+	content, err := os.ReadFile(dstDir.Join("data", "sub", "link1"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "hard linked")
+}
+
+func TestStripComponents(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content"),
+			fs.WithDir("sub", fs.WithFile("file2", "content")),
+		),
+	)
+	assert.NilError(t, os.Link(srcDir.Join("data", "file1"), srcDir.Join("data", "sub", "link1")))
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf)
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), "release-1.0"))
+	assert.NilError(t, c.Close())
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(&buf, dstDir.Path(), WithStripComponents(2)))
+	assert.Assert(t, fs.Equal(dstDir.Path(), fs.Expected(
+		t,
+		fs.MatchAnyFileMode,
+		fs.WithFile("file1", "content", fs.MatchAnyFileMode),
+		fs.WithDir("sub", fs.MatchAnyFileMode,
+			fs.WithFile("file2", "content", fs.MatchAnyFileMode),
+			fs.WithFile("link1", "content", fs.MatchAnyFileMode),
+		),
+	)))
+}
+
+func TestCallback(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content"),
+			fs.WithFile("file2", strings.Repeat("a", 1<<20)),
+			fs.WithDir("sub", fs.WithFile("file3", "content")),
+		),
+	)
+	var (
+		buf      bytes.Buffer
+		entries  []string
+		lastDone int64
+	)
+	c, err := NewComposer(&buf, WithCallback(func(header *tar.Header, done int64, err error) {
+		assert.NilError(t, err)
+		entries = append(entries, header.Name)
+		lastDone = done
+	}))
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	assert.Equal(t, len(entries), 5)
+	assert.Equal(t, lastDone, int64(1<<20+14))
+	progress := NewProgress(int64(buf.Len()))
+	dstDir := fs.NewDir(t, "dst")
+	err = Resolve(progress.Reader(&buf), dstDir.Path(), WithCallback(progress.Callback), WithThreshold(1024))
+	assert.NilError(t, err)
+	stat := progress.Stat()
+	assert.Equal(t, stat.Files, int64(5))
+	assert.Equal(t, stat.Bytes, int64(1<<20+14))
+	assert.Equal(t, stat.Errors, int64(0))
+}
+
+func TestContext(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content"),
+			fs.WithFile("file2", "content"),
+			fs.WithDir("sub", fs.WithFile("file3", "content")),
+		),
+	)
+	// Cancel the creation after the first entry.
+	var buf bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := NewComposer(&buf, WithCallback(func(*tar.Header, int64, error) { cancel() }))
+	assert.NilError(t, err)
+	err = c.AddContext(ctx, srcDir.Join("data"), "")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NilError(t, c.Close())
+	// Cancel the extraction after the first entry.
+	buf.Reset()
+	c, err = NewComposer(&buf)
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	ctx, cancel = context.WithCancel(context.Background())
+	dstDir := fs.NewDir(t, "dst")
+	err = ResolveContext(ctx, &buf, dstDir.Path(), WithThread(1), WithCallback(func(*tar.Header, int64, error) { cancel() }))
+	assert.ErrorIs(t, err, context.Canceled)
+	// A done context stops everything.
+	err = ResolveContext(ctx, &buf, dstDir.Path())
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSpecialFiles(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data"))
+	assert.NilError(t, unix.Mkfifo(srcDir.Join("data", "fifo"), 0o640))
+	isRoot := os.Geteuid() == 0
+	if isRoot {
+		assert.NilError(t, unix.Mknod(srcDir.Join("data", "null"), unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))))
+	}
+	listener, err := net.Listen("unix", srcDir.Join("data", "socket"))
+	assert.NilError(t, err)
+	defer func() { _ = listener.Close() }()
+	// Sockets cannot be archived.
+	c, err := NewComposer(io.Discard)
+	assert.NilError(t, err)
+	assert.ErrorContains(t, c.Add(srcDir.Join("data"), ""), "sockets not supported")
+	dstDir := roundTrip(t, srcDir.Join("data"), []Option{WithSkipUnsupported()})
+	var stat unix.Stat_t
+	assert.NilError(t, unix.Lstat(dstDir.Join("data", "fifo"), &stat))
+	assert.Equal(t, uint32(stat.Mode)&unix.S_IFMT, uint32(unix.S_IFIFO))
+	assert.Equal(t, uint32(stat.Mode)&0o777, uint32(0o640))
+	if isRoot {
+		assert.NilError(t, unix.Lstat(dstDir.Join("data", "null"), &stat))
+		assert.Equal(t, uint32(stat.Mode)&unix.S_IFMT, uint32(unix.S_IFCHR))
+		assert.Equal(t, uint64(stat.Rdev), unix.Mkdev(1, 3))
+	}
+	_, err = os.Lstat(dstDir.Join("data", "socket"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestXattrs(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content"),
+			fs.WithDir("sub"),
+		),
+	)
+	err := unix.Lsetxattr(srcDir.Join("data", "file1"), "user.vaar", []byte("file\x00value"), 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("extended attributes are not supported")
+	}
+	assert.NilError(t, err)
+	assert.NilError(t, unix.Lsetxattr(srcDir.Join("data", "sub"), "user.vaar", []byte("dir"), 0))
+	dstDir := roundTrip(t, srcDir.Join("data"), []Option{WithXattrs()}, WithXattrs())
+	xattrs, err := readPathXattrs(dstDir.Join("data", "file1"))
+	assert.NilError(t, err)
+	assert.Equal(t, xattrs["user.vaar"], "file\x00value")
+	xattrs, err = readPathXattrs(dstDir.Join("data", "sub"))
+	assert.NilError(t, err)
+	assert.Equal(t, xattrs["user.vaar"], "dir")
+	// They are not preserved by default.
+	dstDir = roundTrip(t, srcDir.Join("data"), nil)
+	xattrs, err = readPathXattrs(dstDir.Join("data", "file1"))
+	assert.NilError(t, err)
+	assert.Equal(t, xattrs["user.vaar"], "")
+	// Symlinks and named pipes only accept trusted attributes, which require root.
+	assert.NilError(t, os.Symlink("file1", srcDir.Join("data", "link")))
+	assert.NilError(t, unix.Mkfifo(srcDir.Join("data", "fifo"), 0o644))
+	for _, name := range []string{"link", "fifo"} {
+		err = unix.Lsetxattr(srcDir.Join("data", name), "trusted.vaar", []byte(name), 0)
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("trusted extended attributes require root")
+		}
+		assert.NilError(t, err)
+	}
+	dstDir = roundTrip(t, srcDir.Join("data"), []Option{WithXattrs()}, WithXattrs())
+	for _, name := range []string{"link", "fifo"} {
+		xattrs, err = readPathXattrs(dstDir.Join("data", name))
+		assert.NilError(t, err)
+		assert.Equal(t, xattrs["trusted.vaar"], name)
+	}
+	// The symlink is not followed.
+	xattrs, err = readPathXattrs(dstDir.Join("data", "file1"))
+	assert.NilError(t, err)
+	assert.Equal(t, xattrs["trusted.vaar"], "")
+}
+
+func TestCompression(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", strings.Repeat("compressible ", 1<<16)),
+			fs.WithFile("file2", "small"),
+		),
+	)
+	for _, algorithm := range []Algorithm{NoAlgorithm, GzipAlgorithm, LZ4Algorithm, ZstdAlgorithm} {
+		for _, level := range []Level{FastestLevel, DefaultLevel, BestLevel} {
+			t.Run(algorithm.String()+"/"+level.String(), func(t *testing.T) {
+				dstDir := roundTrip(
+					t, srcDir.Join("data"),
+					[]Option{WithCompression(algorithm), WithLevel(level), WithCompressionThreads(2)},
+					WithCompression(algorithm), WithCompressionThreads(2),
+				)
+				content, err := os.ReadFile(dstDir.Join("data", "file1"))
+				assert.NilError(t, err)
+				assert.Equal(t, string(content), strings.Repeat("compressible ", 1<<16))
+				dstDir = roundTrip(
+					t, srcDir.Join("data"),
+					[]Option{WithCompression(algorithm), WithLevel(level)},
+					WithCompression(AutoAlgorithm),
+				)
+				content, err = os.ReadFile(dstDir.Join("data", "file2"))
+				assert.NilError(t, err)
+				assert.Equal(t, string(content), "small")
+			})
+		}
+	}
+	// An uncompressed tarball starting with a name like the bzip2 header is not detected as bzip2.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "BZh91AY", Size: 7, Mode: 0o644}))
+	_, err := tw.Write([]byte("content"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(&buf, dstDir.Path(), WithCompression(AutoAlgorithm)))
+	content, err := os.ReadFile(dstDir.Join("BZh91AY"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), "content")
+}
+
+func TestUnsafePaths(t *testing.T) {
+	outsideDir := fs.NewDir(t, "outside", fs.WithFile("secret", "secret"))
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"traversal", []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "a/../../passwd", Mode: 0o644, Size: 4},
+		}},
+		{"file through absolute symlink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outsideDir.Path(), Mode: 0o777},
+			{Typeflag: tar.TypeReg, Name: "a/passwd", Mode: 0o644, Size: 4},
+		}},
+		{"file through relative symlink", []*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "sub", Mode: 0o755},
+			{Typeflag: tar.TypeSymlink, Name: "sub/a", Linkname: "../..", Mode: 0o777},
+			{Typeflag: tar.TypeReg, Name: "sub/a/passwd", Mode: 0o644, Size: 4},
+		}},
+		{"directory through symlink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outsideDir.Path(), Mode: 0o777},
+			{Typeflag: tar.TypeDir, Name: "a/passwd", Mode: 0o755},
+		}},
+		{"symlink through symlink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outsideDir.Path(), Mode: 0o777},
+			{Typeflag: tar.TypeSymlink, Name: "a/passwd", Linkname: "/", Mode: 0o777},
+		}},
+		{"hard link through symlink", []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outsideDir.Path(), Mode: 0o777},
+			{Typeflag: tar.TypeLink, Name: "passwd", Linkname: "a/secret"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, header := range test.headers {
+				assert.NilError(t, tw.WriteHeader(header))
+				if header.Typeflag == tar.TypeReg {
+					_, err := tw.Write([]byte("evil"))
+					assert.NilError(t, err)
+				}
+			}
+			assert.NilError(t, tw.Close())
+			dstDir := fs.NewDir(t, "dst")
+			// A single worker keeps the order of entries.
+			err := Resolve(&buf, dstDir.Path(), WithThread(1))
+			var unsafeErr *UnsafePathError
+			assert.Assert(t, errors.As(err, &unsafeErr), "unexpected error: %v", err)
+			assert.Assert(t, fs.Equal(outsideDir.Path(), fs.Expected(
+				t, fs.MatchAnyFileMode, fs.WithFile("secret", "secret", fs.MatchAnyFileMode),
+			)))
+			_, err = os.Lstat(filepath.Join(filepath.Dir(dstDir.Path()), "passwd"))
+			assert.Assert(t, os.IsNotExist(err))
+			_, err = os.Lstat(dstDir.Join("passwd"))
+			assert.Assert(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestReplaceSymlink(t *testing.T) {
+	outsideDir := fs.NewDir(t, "outside", fs.WithFile("secret", "secret"))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink, Name: "a", Linkname: outsideDir.Join("secret"), Mode: 0o777,
+	}))
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644, Size: 4}))
+	_, err := tw.Write([]byte("evil"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(&buf, dstDir.Path(), WithThread(1)))
+	// The symlink is replaced instead of being written through.
+	assert.Assert(t, fs.Equal(dstDir.Path(), fs.Expected(
+		t, fs.MatchAnyFileMode, fs.WithFile("a", "evil", fs.MatchAnyFileMode),
+	)))
+	assert.Assert(t, fs.Equal(outsideDir.Path(), fs.Expected(
+		t, fs.MatchAnyFileMode, fs.WithFile("secret", "secret", fs.MatchAnyFileMode),
+	)))
+}
+
+func TestSparse(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithFile("file", "")))
+	file, err := os.OpenFile(srcDir.Join("data", "file"), os.O_WRONLY, 0)
+	assert.NilError(t, err)
+	_, err = file.WriteAt([]byte("head"), 0)
+	assert.NilError(t, err)
+	_, err = file.WriteAt([]byte("middle"), 4<<20)
+	assert.NilError(t, err)
+	assert.NilError(t, file.Truncate(16<<20))
+	segments, err := findDataSegments(int(file.Fd()), 16<<20)
+	assert.NilError(t, err)
+	assert.NilError(t, file.Close())
+	if segments == nil {
+		t.Skip("holes are not supported")
+	}
+	expected, err := os.ReadFile(srcDir.Join("data", "file"))
+	assert.NilError(t, err)
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf, WithSparse())
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+	assert.NilError(t, c.Close())
+	assert.Assert(t, buf.Len() < 1<<20, "holes are archived: %d bytes", buf.Len())
+	// The tarball can be read by archive/tar.
+	var names []string
+	assert.NilError(t, List(bytes.NewReader(buf.Bytes()), func(header *tar.Header) error {
+		names = append(names, header.Name)
+		if header.Typeflag == tar.TypeReg {
+			assert.Equal(t, header.Size, int64(16<<20))
+		}
+		return nil
+	}))
+	assert.DeepEqual(t, names, []string{"data", "data/file"})
+	for _, threshold := range []int64{1024, 32 << 20} {
+		dstDir := fs.NewDir(t, "dst")
+		assert.NilError(t, Resolve(bytes.NewReader(buf.Bytes()), dstDir.Path(), WithThreshold(threshold)))
+		content, err := os.ReadFile(dstDir.Join("data", "file"))
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(content, expected))
+		var stat unix.Stat_t
+		assert.NilError(t, unix.Stat(dstDir.Join("data", "file"), &stat))
+		assert.Assert(t, stat.Blocks*512 < 1<<20, "holes are not recreated: %d blocks", stat.Blocks)
+	}
+}
+
+func TestDirectoryMetadata(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithDir("readonly", fs.WithMode(0o555),
+				fs.WithFile("file", "content", fs.WithMode(0o444)),
+				fs.WithDir("sub", fs.WithMode(0o500), fs.WithFile("file", "content")),
+			),
+			fs.WithDir("private", fs.WithMode(0o700)),
+		),
+	)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, dir := range []string{"data", "data/readonly", "data/readonly/sub", "data/private"} {
+		assert.NilError(t, os.Chtimes(srcDir.Join(dir), mtime, mtime))
+	}
+	dstDir := roundTrip(t, srcDir.Join("data"), nil, WithThread(8))
+	for _, dir := range []*fs.Dir{srcDir, dstDir} {
+		// Make the directories removable by the cleanup.
+		dir := dir
+		t.Cleanup(func() {
+			_ = filepath.Walk(dir.Path(), func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.IsDir() {
+					_ = os.Chmod(path, 0o755)
+				}
+				return nil
+			})
+		})
+	}
+	assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.ManifestFromDir(t, srcDir.Join("data"))))
+	for _, dir := range []string{"data", "data/readonly", "data/readonly/sub", "data/private"} {
+		info, err := os.Stat(dstDir.Join(dir))
+		assert.NilError(t, err)
+		assert.Assert(t, info.ModTime().Equal(mtime), "modification time of %s: %v", dir, info.ModTime())
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	epoch := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	setenv(t, "SOURCE_DATE_EPOCH", "1609556645")
+	// The same tree, with files created in different orders and at different times.
+	names := []string{"b", "a", "sub/d", "sub/c", "e"}
+	var tarballs [2][]byte
+	for i := range tarballs {
+		srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithDir("sub")))
+		for j := range names {
+			name := names[j]
+			if i == 1 {
+				name = names[len(names)-1-j]
+			}
+			assert.NilError(t, os.WriteFile(srcDir.Join("data", name), []byte(name), 0o644))
+		}
+		old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		assert.NilError(t, os.Chtimes(srcDir.Join("data", "a"), old, old))
+		var buf bytes.Buffer
+		c, err := NewComposer(&buf, WithReproducible(), WithThread(1+i*7), WithCompression(ZstdAlgorithm))
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+		assert.NilError(t, c.Close())
+		tarballs[i] = buf.Bytes()
+	}
+	assert.Assert(t, bytes.Equal(tarballs[0], tarballs[1]))
+	var listed []string
+	assert.NilError(t, List(bytes.NewReader(tarballs[0]), func(header *tar.Header) error {
+		listed = append(listed, header.Name)
+		assert.Equal(t, header.Uid, 0)
+		assert.Equal(t, header.Uname, "")
+		assert.Assert(t, header.AccessTime.IsZero())
+		if header.Name == "data/a" {
+			assert.Assert(t, header.ModTime.Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)))
+		} else {
+			assert.Assert(t, header.ModTime.Equal(epoch), "modification time of %s: %v", header.Name, header.ModTime)
+		}
+		return nil
+	}, WithCompression(ZstdAlgorithm)))
+	assert.DeepEqual(t, listed, []string{"data", "data/a", "data/b", "data/e", "data/sub", "data/sub/c", "data/sub/d"})
+	// Invalid epochs are rejected.
+	setenv(t, "SOURCE_DATE_EPOCH", "yesterday")
+	_, err := NewComposer(io.Discard, WithReproducible())
+	assert.ErrorContains(t, err, "SOURCE_DATE_EPOCH")
+}
+
+func TestOwnership(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithFile("file", "content")))
+	listOwners := func(options ...Option) []string {
+		var buf bytes.Buffer
+		c, err := NewComposer(&buf, options...)
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+		assert.NilError(t, c.Close())
+		var owners []string
+		assert.NilError(t, List(&buf, func(header *tar.Header) error {
+			owners = append(owners, fmt.Sprintf("%s(%d):%s(%d)", header.Uname, header.Uid, header.Gname, header.Gid))
+			return nil
+		}))
+		return owners
+	}
+	assert.DeepEqual(t, listOwners(WithOwner("someone", 1234), WithGroup("", 5678)), []string{
+		"someone(1234):(5678)", "someone(1234):(5678)",
+	})
+	uid, gid := os.Getuid(), os.Getgid()
+	mapped := fmt.Sprintf("(1):(%d)", gid)
+	assert.DeepEqual(t, listOwners(WithUIDMappings(IDMapping{ContainerID: 1, HostID: uid, Size: 1}), WithNumericOwner()), []string{
+		mapped, mapped,
+	})
+	c, err := NewComposer(io.Discard, WithGIDMappings(IDMapping{ContainerID: 0, HostID: gid + 1, Size: 1}))
+	assert.NilError(t, err)
+	assert.ErrorContains(t, c.Add(srcDir.Join("data"), ""), "is not mapped")
+	_, err = NewComposer(io.Discard, WithUIDMappings(IDMapping{ContainerID: 0, HostID: 0, Size: 0}))
+	assert.ErrorContains(t, err, "invalid ID mapping")
+	// Extraction.
+	if os.Geteuid() != 0 {
+		t.Skip("files cannot be chowned")
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: "file", Mode: 0o644, Uid: 4321, Gid: 8765, Uname: "root", Gname: "no-such-group",
+	}))
+	assert.NilError(t, tw.Close())
+	for _, tc := range []struct {
+		options  []Option
+		uid, gid uint32
+	}{
+		{options: nil, uid: 0, gid: 8765},
+		{options: []Option{WithNumericOwner()}, uid: 4321, gid: 8765},
+		{
+			options: []Option{
+				WithUIDMappings(IDMapping{ContainerID: 0, HostID: 100000, Size: 65536}),
+				WithGIDMappings(IDMapping{ContainerID: 8000, HostID: 200000, Size: 1000}),
+			},
+			uid: 104321, gid: 200765,
+		},
+	} {
+		dstDir := fs.NewDir(t, "dst")
+		assert.NilError(t, Resolve(bytes.NewReader(buf.Bytes()), dstDir.Path(), tc.options...))
+		var stat unix.Stat_t
+		assert.NilError(t, unix.Stat(dstDir.Join("file"), &stat))
+		assert.Equal(t, stat.Uid, tc.uid)
+		assert.Equal(t, stat.Gid, tc.gid)
+	}
+	err = Resolve(bytes.NewReader(buf.Bytes()), t.TempDir(), WithUIDMappings(IDMapping{ContainerID: 0, HostID: 0, Size: 1000}))
+	assert.ErrorContains(t, err, "uid 4321 of file is not mapped")
+}
+
+func TestIncremental(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content1"),
+			fs.WithFile("file2", "content2"),
+			fs.WithDir("sub", fs.WithFile("file3", "content3")),
+		),
+	)
+	snapshot := NewSnapshot()
+	compose := func() ([]byte, []string) {
+		var buf bytes.Buffer
+		c, err := NewComposer(&buf, WithSnapshot(snapshot))
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+		assert.NilError(t, c.Close())
+		var names []string
+		assert.NilError(t, List(bytes.NewReader(buf.Bytes()), func(header *tar.Header) error {
+			if header.Typeflag != tar.TypeXGlobalHeader {
+				names = append(names, header.Name)
+			}
+			return nil
+		}))
+		return buf.Bytes(), names
+	}
+	full, names := compose()
+	assert.DeepEqual(t, names, []string{"data", "data/file1", "data/file2", "data/sub", "data/sub/file3"})
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(bytes.NewReader(full), dstDir.Path(), WithIncremental()))
+	// Change the tree, and save and load the snapshot.
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "file1"), []byte("changed"), 0o644))
+	assert.NilError(t, os.Remove(srcDir.Join("data", "file2")))
+	assert.NilError(t, os.RemoveAll(srcDir.Join("data", "sub")))
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "file4"), []byte("content4"), 0o644))
+	var saved bytes.Buffer
+	_, err := snapshot.WriteTo(&saved)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(saved.String(), "vaar-snapshot 1\n"))
+	snapshot, err = ReadSnapshot(&saved)
+	assert.NilError(t, err)
+	incremental, names := compose()
+	assert.DeepEqual(t, names, []string{"data", "data/file1", "data/file4"})
+	// Deleted files are kept without WithIncremental.
+	keptDir := fs.NewDir(t, "kept")
+	assert.NilError(t, Resolve(bytes.NewReader(full), keptDir.Path()))
+	assert.NilError(t, Resolve(bytes.NewReader(incremental), keptDir.Path()))
+	_, err = os.Stat(keptDir.Join("data", "sub", "file3"))
+	assert.NilError(t, err)
+	assert.NilError(t, Resolve(bytes.NewReader(incremental), dstDir.Path(), WithIncremental()))
+	assert.Assert(t, fs.Equal(dstDir.Join("data"), fs.ManifestFromDir(t, srcDir.Join("data"))))
+	// Nothing changes afterwards.
+	_, names = compose()
+	assert.DeepEqual(t, names, []string{"data"})
+	_, err = ReadSnapshot(strings.NewReader("vaar-snapshot 1\n1 2 3\n"))
+	assert.ErrorContains(t, err, "invalid snapshot line 2")
+}
+
+func TestIncrementalHardLinks(t *testing.T) {
+	srcDir := fs.NewDir(t, "src", fs.WithDir("data", fs.WithFile("file", "content")))
+	assert.NilError(t, os.Link(srcDir.Join("data", "file"), srcDir.Join("data", "link")))
+	snapshot := NewSnapshot()
+	compose := func() []*tar.Header {
+		var buf bytes.Buffer
+		// Both names have the same inode, so they're sorted by names to make the target come first.
+		c, err := NewComposer(&buf, WithSnapshot(snapshot), WithReproducible())
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+		assert.NilError(t, c.Close())
+		var headers []*tar.Header
+		assert.NilError(t, List(bytes.NewReader(buf.Bytes()), func(header *tar.Header) error {
+			if header.Typeflag != tar.TypeXGlobalHeader {
+				headers = append(headers, header)
+			}
+			return nil
+		}))
+		return headers
+	}
+	headers := compose()
+	assert.Equal(t, len(headers), 3)
+	assert.Equal(t, headers[2].Typeflag, byte(tar.TypeLink))
+	// The link is new to the snapshot, like one moved in, while its target is unchanged and skipped.
+	// It must be archived with the content instead of linking to the target absent from the tarball.
+	delete(snapshot.files, "data/link")
+	headers = compose()
+	assert.Equal(t, len(headers), 2)
+	assert.Equal(t, headers[1].Name, "data/link")
+	assert.Equal(t, headers[1].Typeflag, byte(tar.TypeReg))
+	assert.Equal(t, headers[1].Size, int64(len("content")))
+}
+
+func TestAppend(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file1", "content1"),
+			fs.WithFile("file2", strings.Repeat("content2", 1000)),
+		),
+		fs.WithDir("more", fs.WithFile("file3", "content3")),
+	)
+	old := time.Unix(1609556645, 0)
+	for _, name := range []string{"data/file1", "data/file2", "data"} {
+		assert.NilError(t, os.Chtimes(srcDir.Join(name), old, old))
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive.tar"))
+	assert.NilError(t, err)
+	defer func() { _ = f.Close() }()
+	appendTo := func(path string, options ...Option) []string {
+		c, err := NewAppendComposer(f, options...)
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(path, ""))
+		assert.NilError(t, c.Close())
+		_, err = f.Seek(0, io.SeekStart)
+		assert.NilError(t, err)
+		var names []string
+		assert.NilError(t, List(f, func(header *tar.Header) error {
+			names = append(names, header.Name)
+			return nil
+		}))
+		return names
+	}
+	// An empty file is a new tarball.
+	names := appendTo(srcDir.Join("data"))
+	assert.DeepEqual(t, names, []string{"data", "data/file1", "data/file2"})
+	// Pad the tarball like GNU tar, which writes in records of 10 KiB.
+	stat, err := f.Stat()
+	assert.NilError(t, err)
+	assert.NilError(t, f.Truncate(stat.Size()+8192))
+	names = appendTo(srcDir.Join("more"))
+	assert.DeepEqual(t, names, []string{"data", "data/file1", "data/file2", "more", "more/file3"})
+	// Only the newer files are added in update mode.
+	assert.NilError(t, os.WriteFile(srcDir.Join("data", "file1"), []byte("changed"), 0o644))
+	names = appendTo(srcDir.Join("data"), WithUpdate())
+	assert.DeepEqual(t, names, []string{"data", "data/file1", "data/file2", "more", "more/file3", "data/file1"})
+	dstDir := fs.NewDir(t, "dst")
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NilError(t, err)
+	assert.NilError(t, Resolve(f, dstDir.Path()))
+	assert.Assert(t, fs.Equal(dstDir.Path(), fs.ManifestFromDir(t, srcDir.Path())))
+	_, err = NewAppendComposer(f, WithCompression(GzipAlgorithm))
+	assert.ErrorContains(t, err, "cannot be appended")
+	_, err = NewComposer(io.Discard, WithUpdate())
+	assert.ErrorContains(t, err, "update mode")
+}
+
+func TestChecksums(t *testing.T) {
+	srcDir := fs.NewDir(
+		t, "src",
+		fs.WithDir("data",
+			fs.WithFile("file", "content"),
+			fs.WithFile("empty", ""),
+			fs.WithSymlink("link", "file"),
+		),
+	)
+	// A file larger than the copy buffer is hashed before being copied.
+	large, err := os.Create(srcDir.Join("data", "large"))
+	assert.NilError(t, err)
+	_, err = large.WriteAt([]byte("tail"), composerDefaultBufSize)
+	assert.NilError(t, err)
+	assert.NilError(t, large.Close())
+	for _, checksum := range []Checksum{SHA256Checksum, BLAKE3Checksum, XXH3Checksum} {
+		t.Run(checksum.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			c, err := NewComposer(&buf, WithChecksums(checksum))
+			assert.NilError(t, err)
+			assert.NilError(t, c.Add(srcDir.Join("data"), ""))
+			assert.NilError(t, c.Close())
+			digests := make(map[string]string)
+			assert.NilError(t, List(bytes.NewReader(buf.Bytes()), func(header *tar.Header) error {
+				if digest, ok := header.PAXRecords["VAAR."+checksum.String()]; ok {
+					digests[header.Name] = digest
+				}
+				return nil
+			}))
+			assert.Equal(t, len(digests), 3)
+			if checksum == SHA256Checksum {
+				assert.Equal(t, digests["data/file"], "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73")
+			}
+			for _, threshold := range []int64{0, 1 << 10} {
+				dstDir := fs.NewDir(t, "dst")
+				options := []Option{WithChecksums(checksum), WithThreshold(threshold)}
+				assert.NilError(t, Resolve(bytes.NewReader(buf.Bytes()), dstDir.Path(), options...))
+				assert.Assert(t, fs.Equal(dstDir.Path(), fs.ManifestFromDir(t, srcDir.Path())))
+			}
+			// Corrupt the content of the file.
+			corrupted := bytes.Replace(buf.Bytes(), []byte("content"), []byte("CONTENT"), 1)
+			for _, threshold := range []int64{0, 1 << 10} {
+				dstDir := t.TempDir()
+				err := Resolve(bytes.NewReader(corrupted), dstDir, WithChecksums(checksum), WithThreshold(threshold))
+				var checksumErr *ChecksumError
+				assert.Assert(t, errors.As(err, &checksumErr), "unexpected error: %v", err)
+				assert.Equal(t, checksumErr.Name, "data/file")
+				assert.Equal(t, checksumErr.Checksum, checksum)
+				assert.Equal(t, checksumErr.Expected, digests["data/file"])
+				// The corrupted file is removed.
+				_, err = os.Lstat(filepath.Join(dstDir, "data", "file"))
+				assert.Assert(t, errors.Is(err, os.ErrNotExist), "unexpected error: %v", err)
+			}
+			// The digests are not verified without the option.
+			assert.NilError(t, Resolve(bytes.NewReader(corrupted), t.TempDir()))
+		})
+	}
+	// A big file changed between the reads fails the creation, instead of storing a wrong digest.
+	content := make([]byte, composerDefaultBufSize+1)
+	c, err := NewComposer(io.Discard, WithChecksums(SHA256Checksum))
+	assert.NilError(t, err)
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: "big", Size: int64(len(content)), Mode: 0o644}
+	err = c.writeFile(context.Background(), header, &changingReader{Reader: bytes.NewReader(content), content: content})
+	assert.ErrorContains(t, err, "file changed when reading")
+}
+
+// changingReader changes the content when it's read again from the start.
+type changingReader struct {
+	*bytes.Reader
+	content []byte
+}
+
+func (r *changingReader) Seek(offset int64, whence int) (int64, error) {
+	r.content[0]++
+	return r.Reader.Seek(offset, whence)
+}
+
+// setenv sets an environment variable until the test ends, like t.Setenv which requires Go 1.17.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	assert.NilError(t, os.Setenv(key, value))
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+// roundTrip archives path and extracts it to a new temporary directory.
+func roundTrip(t *testing.T, path string, composerOptions []Option, options ...Option) *fs.Dir {
+	t.Helper()
+	var buf bytes.Buffer
+	c, err := NewComposer(&buf, composerOptions...)
+	assert.NilError(t, err)
+	assert.NilError(t, c.Add(path, ""))
+	assert.NilError(t, c.Close())
+	dstDir := fs.NewDir(t, "dst")
+	assert.NilError(t, Resolve(&buf, dstDir.Path(), options...))
+	_, err = os.Stat(filepath.Join(dstDir.Path(), filepath.Base(path)))
+	assert.NilError(t, err)
+	return dstDir
+}
@@ -0,0 +1,159 @@
+package vaar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotMagic = "vaar-snapshot 1"
+	// paxDeleted is the PAX record in a global header listing the files deleted since the snapshot, separated by NUL.
+	paxDeleted = "VAAR.deleted"
+)
+
+// Snapshot is the state of the files archived, used to create incremental tarballs.
+// Files unchanged since the snapshot are not archived again, and files deleted are listed in the tarball.
+// A Snapshot is updated by the Composer using it when it's closed, and it can be saved for the next run.
+type Snapshot struct {
+	files map[string]*snapshotFile // Files in the snapshot by their names in the tarball.
+	// Runtime fields of the Composer.
+	next  map[string]*snapshotFile // Files walked in this run.
+	roots []string                 // Names of the paths added in this run.
+}
+
+// snapshotFile is the state of a file. The file is considered unchanged if none of the fields changes.
+type snapshotFile struct {
+	dev   uint64
+	ino   uint64
+	mtime int64 // In nanoseconds.
+	ctime int64 // In nanoseconds. It changes with the mode, the owners and the extended attributes.
+	size  int64
+}
+
+// NewSnapshot creates an empty Snapshot, with which a full tarball is created.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{files: make(map[string]*snapshotFile)}
+}
+
+// ReadSnapshot reads a Snapshot saved with WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	s := NewSnapshot()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	if !scanner.Scan() || scanner.Text() != snapshotMagic {
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		return nil, errors.New("invalid snapshot header")
+	}
+	for line := 2; scanner.Scan(); line++ {
+		// Each line is like: dev ino mtime ctime size "name"
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid snapshot line %d", line)
+		}
+		var values [5]int64
+		for i := range values {
+			v, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid snapshot line %d: %w", line, err)
+			}
+			values[i] = v
+		}
+		name, err := strconv.Unquote(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot line %d: %w", line, err)
+		}
+		s.files[name] = &snapshotFile{
+			dev:   uint64(values[0]),
+			ino:   uint64(values[1]),
+			mtime: values[2],
+			ctime: values[3],
+			size:  values[4],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	return s, nil
+}
+
+// WriteTo saves the Snapshot in a text format, one file per line sorted by the names.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	var n int64
+	written, err := fmt.Fprintln(bw, snapshotMagic)
+	n += int64(written)
+	if err != nil {
+		return n, err
+	}
+	for _, name := range names {
+		f := s.files[name]
+		written, err := fmt.Fprintf(bw, "%d %d %d %d %d %s\n", int64(f.dev), int64(f.ino), f.mtime, f.ctime, f.size, strconv.Quote(name))
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// addRoot marks the name as a path added, under which files not walked are deleted.
+func (s *Snapshot) addRoot(name string) {
+	if s.next == nil {
+		s.next = make(map[string]*snapshotFile)
+	}
+	s.roots = append(s.roots, name)
+}
+
+// record records the state of a walked file, and reports whether it's unchanged since the snapshot.
+// Directories are never considered unchanged, as their metadata is cheap to archive.
+func (s *Snapshot) record(name string, entry *Entry) bool {
+	f := &snapshotFile{
+		dev:   entry.dev,
+		ino:   entry.ino,
+		mtime: entry.modTime.UnixNano(),
+		ctime: entry.ctime.UnixNano(),
+		size:  entry.size,
+	}
+	s.next[name] = f
+	old, ok := s.files[name]
+	return ok && !entry.IsDir() && *old == *f
+}
+
+// commit replaces the files under the added paths with the walked ones, and returns the names of the deleted files.
+func (s *Snapshot) commit() []string {
+	var deleted []string
+	for name := range s.files {
+		if _, ok := s.next[name]; !ok && s.underRoots(name) {
+			deleted = append(deleted, name)
+			delete(s.files, name)
+		}
+	}
+	for name, f := range s.next {
+		s.files[name] = f
+	}
+	s.next, s.roots = nil, nil
+	sort.Strings(deleted)
+	return deleted
+}
+
+// underRoots reports whether the name is one of the added paths, or is in one of them.
+func (s *Snapshot) underRoots(name string) bool {
+	for _, root := range s.roots {
+		if name == root || strings.HasPrefix(name, root+"/") || root == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package vaar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	blockSize      = 512
+	sparseHoleSize = 4 << 10 // 4 KiB, the common filesystem block size.
+	sparseCopySize = 1 << 20 // 1 MiB
+	// PAX records of the GNU sparse format 1.0.
+	paxGNUSparsePrefix   = "GNU.sparse."
+	paxGNUSparseMajor    = "GNU.sparse.major"
+	paxGNUSparseMinor    = "GNU.sparse.minor"
+	paxGNUSparseName     = "GNU.sparse.name"
+	paxGNUSparseRealSize = "GNU.sparse.realsize"
+)
+
+// sparseEntry is a data segment of a sparse file. Everything else is a hole.
+type sparseEntry struct {
+	offset int64
+	length int64
+}
+
+// findDataSegments finds the data segments of an opened file with the size, using SEEK_DATA and SEEK_HOLE.
+// It returns nil if the file has no holes, or the filesystem doesn't support finding them.
+// The file offset is reset to the beginning.
+func findDataSegments(fd int, size int64) ([]sparseEntry, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	defer func() { _, _ = unix.Seek(fd, 0, io.SeekStart) }()
+	// Most files have no holes. One syscall is enough to tell.
+	hole, err := unix.Seek(fd, 0, unix.SEEK_HOLE)
+	if err != nil || hole >= size {
+		return nil, nil
+	}
+	var segments []sparseEntry
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// No more data. The file ends with a hole.
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek data: %w", err)
+		}
+		if data >= size {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek hole: %w", err)
+		}
+		if hole > size {
+			// The file is growing.
+			hole = size
+		}
+		segments = append(segments, sparseEntry{offset: data, length: hole - data})
+		offset = hole
+	}
+	return segments, nil
+}
+
+// writeSparse writes a regular file with holes in the GNU sparse format 1.0, which is understood by GNU tar,
+// bsdtar and archive/tar. Only the data segments are stored, after a sparse map in the file content.
+// The PAX records are written manually, as tar.Writer drops the GNU.sparse ones.
+func (c *Composer) writeSparse(ctx context.Context, header *tar.Header, file *os.File, segments []sparseEntry) (int64, error) {
+	sparseMap := formatSparseMap(header.Size, segments)
+	storedSize := int64(len(sparseMap))
+	for _, segment := range segments {
+		storedSize += segment.length
+	}
+	// Pad the previous file, so that we're at a header block.
+	if err := c.tw.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(formatSparseHeader(header, storedSize)); err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(sparseMap); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, segment := range segments {
+		r := newContextReader(ctx, io.NewSectionReader(file, segment.offset, segment.length))
+		written, err := io.CopyBuffer(c.w, r, c.buf)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		if written != segment.length {
+			return n, fmt.Errorf("file shrank when reading: %w", io.ErrUnexpectedEOF)
+		}
+	}
+	if pad := blockPadding(storedSize); pad > 0 {
+		if _, err := c.w.Write(make([]byte, pad)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// formatSparseMap formats the sparse map stored at the beginning of the file content, padded to a block.
+func formatSparseMap(size int64, segments []sparseEntry) []byte {
+	if n := len(segments); n == 0 || segments[n-1].offset+segments[n-1].length < size {
+		// Mark the end of a trailing hole with an empty segment, like GNU tar.
+		segments = append(segments, sparseEntry{offset: size})
+	}
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(len(segments)) + "\n")
+	for _, segment := range segments {
+		b.WriteString(strconv.FormatInt(segment.offset, 10) + "\n")
+		b.WriteString(strconv.FormatInt(segment.length, 10) + "\n")
+	}
+	sparseMap := []byte(b.String())
+	return append(sparseMap, make([]byte, blockPadding(int64(len(sparseMap))))...)
+}
+
+// formatSparseHeader formats the PAX extended header and the ustar header of a sparse file.
+// The ustar header names it like GNUSparseFile.0/name, so that old tar implementations extract the raw content
+// without overwriting the real file.
+func formatSparseHeader(header *tar.Header, storedSize int64) []byte {
+	dir, base := path.Split(header.Name)
+	name := path.Join(dir, "GNUSparseFile.0", base)
+	records := map[string]string{
+		paxGNUSparseMajor:    "1",
+		paxGNUSparseMinor:    "0",
+		paxGNUSparseName:     header.Name,
+		paxGNUSparseRealSize: strconv.FormatInt(header.Size, 10),
+		"mtime":              formatPAXTime(header.ModTime),
+	}
+	for k, v := range header.PAXRecords {
+		if !strings.HasPrefix(k, paxGNUSparsePrefix) {
+			records[k] = v
+		}
+	}
+	if !header.AccessTime.IsZero() {
+		records["atime"] = formatPAXTime(header.AccessTime)
+	}
+	if !header.ChangeTime.IsZero() {
+		records["ctime"] = formatPAXTime(header.ChangeTime)
+	}
+	// Values not fitting in the ustar header go to the PAX records.
+	if len(name) > 100 {
+		records["path"] = name
+	}
+	if header.Uid > 0o7777777 {
+		records["uid"] = strconv.Itoa(header.Uid)
+	}
+	if header.Gid > 0o7777777 {
+		records["gid"] = strconv.Itoa(header.Gid)
+	}
+	if len(header.Uname) > 32 {
+		records["uname"] = header.Uname
+	}
+	if len(header.Gname) > 32 {
+		records["gname"] = header.Gname
+	}
+	if storedSize > 0o77777777777 {
+		records["size"] = strconv.FormatInt(storedSize, 10)
+	}
+	paxData := formatPAXRecords(records)
+	var b bytes.Buffer
+	b.Write(formatUstarBlock(&tar.Header{
+		Typeflag: tar.TypeXHeader,
+		Name:     path.Join(dir, "PaxHeaders.0", base),
+		Mode:     0o644,
+		Size:     int64(len(paxData)),
+		ModTime:  header.ModTime,
+	}))
+	b.Write(paxData)
+	b.Write(make([]byte, blockPadding(int64(len(paxData)))))
+	b.Write(formatUstarBlock(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     header.Mode,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		Size:     storedSize,
+		ModTime:  header.ModTime,
+	}))
+	return b.Bytes()
+}
+
+// formatPAXRecords formats PAX records sorted by keys, like "30 mtime=1646975386.123456789\n".
+func formatPAXRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		// The length includes the length field itself, which may have one more digit after being added.
+		v := records[k]
+		size := len(k) + len(v) + 3
+		size += len(strconv.Itoa(size))
+		record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+		if len(record) != size {
+			record = strconv.Itoa(len(record)) + " " + k + "=" + v + "\n"
+		}
+		b.WriteString(record)
+	}
+	return b.Bytes()
+}
+
+// formatPAXTime formats a timestamp in seconds with an optional fraction, like "1646975386.123456789".
+func formatPAXTime(t time.Time) string {
+	sec, nsec := t.Unix(), t.Nanosecond()
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if sec < 0 {
+		// The fraction is always positive in the record, like -1.5 for one and a half seconds before the epoch.
+		sign = "-"
+		sec = -(sec + 1)
+		nsec = 1e9 - nsec
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, sec, nsec), "0")
+}
+
+// formatUstarBlock formats a ustar header block. Values not fitting in the fields are left zero.
+func formatUstarBlock(header *tar.Header) []byte {
+	block := make([]byte, blockSize)
+	copy(block[0:100], header.Name)
+	formatOctal(block[100:108], header.Mode)
+	formatOctal(block[108:116], int64(header.Uid))
+	formatOctal(block[116:124], int64(header.Gid))
+	formatOctal(block[124:136], header.Size)
+	formatOctal(block[136:148], header.ModTime.Unix())
+	block[156] = header.Typeflag
+	copy(block[257:265], "ustar\x0000")
+	copy(block[265:297], header.Uname)
+	copy(block[297:329], header.Gname)
+	// The checksum is calculated with its own field filled with spaces.
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+// formatOctal formats a number in a NUL-terminated octal field. Zero is used if it doesn't fit.
+func formatOctal(b []byte, v int64) {
+	s := strconv.FormatInt(v, 8)
+	if v < 0 || len(s) >= len(b) {
+		s = "0"
+	}
+	copy(b, strings.Repeat("0", len(b)-1-len(s))+s)
+}
+
+// blockPadding returns the number of bytes to pad the size to a whole block.
+func blockPadding(size int64) int64 {
+	return -size & (blockSize - 1)
+}
+
+// isSparse reports whether the header is a sparse file, whose holes are read as zeros from tar.Reader.
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range header.PAXRecords {
+		if strings.HasPrefix(k, paxGNUSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies the content of a sparse file with the size from r to file, skipping zero blocks to leave holes.
+// The file must be empty. It's truncated to the size in the end, in case the file ends with a hole.
+func copySparse(file *os.File, r io.Reader, size int64) (int64, error) {
+	buf := make([]byte, sparseCopySize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		for i := 0; i < n; i += sparseHoleSize {
+			end := i + sparseHoleSize
+			if end > n {
+				end = n
+			}
+			chunk := buf[i:end]
+			if isZero(chunk) {
+				continue
+			}
+			if _, err := file.WriteAt(chunk, offset+int64(i)); err != nil {
+				return offset + int64(i), err
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+	}
+	if offset != size {
+		return offset, io.ErrUnexpectedEOF
+	}
+	return offset, file.Truncate(size)
+}
+
+// isZero reports whether all bytes are zero.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -6,16 +6,93 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-var (
-	users  = make(map[uint32]string)
-	groups = make(map[uint32]string)
-)
+// NameResolver resolves the names of users and groups by their IDs, returning empty names for unknown ones.
+// It must be safe for concurrent use, as files are stated concurrently by ParallelWalk.
+type NameResolver interface {
+	User(uid uint32) string
+	Group(gid uint32) string
+}
+
+// NopNameResolver never looks up names, so that only the IDs are recorded.
+var NopNameResolver NameResolver = nopNameResolver{}
+
+// defaultNameResolver is used by Stat, StatAt and Composers without WithNameResolver.
+var defaultNameResolver = NewCachedNameResolver()
+
+type nopNameResolver struct{}
+
+func (nopNameResolver) User(uint32) string {
+	return ""
+}
+
+func (nopNameResolver) Group(uint32) string {
+	return ""
+}
+
+// cachedNameResolver looks up the local users and groups, and caches the results, including the unknown ones.
+type cachedNameResolver struct {
+	lock   sync.Mutex
+	users  map[uint32]*cachedName
+	groups map[uint32]*cachedName
+}
+
+// cachedName is the name of an ID, looked up once.
+type cachedName struct {
+	once sync.Once
+	name string
+}
+
+// NewCachedNameResolver creates a NameResolver looking up the local users and groups with os/user.
+// The results are cached forever, so that each ID is looked up only once.
+func NewCachedNameResolver() NameResolver {
+	return &cachedNameResolver{
+		users:  make(map[uint32]*cachedName),
+		groups: make(map[uint32]*cachedName),
+	}
+}
+
+func (r *cachedNameResolver) User(uid uint32) string {
+	return r.get(r.users, uid, func(id string) string {
+		u, _ := user.LookupId(id)
+		if u == nil {
+			return ""
+		}
+		return u.Username
+	})
+}
+
+func (r *cachedNameResolver) Group(gid uint32) string {
+	return r.get(r.groups, gid, func(id string) string {
+		g, _ := user.LookupGroupId(id)
+		if g == nil {
+			return ""
+		}
+		return g.Name
+	})
+}
+
+// get returns the name of the ID in the cache, calling lookup on misses.
+// The lookup may be slow with NSS or LDAP, so it's done outside the lock. Only the callers of the same ID wait for it.
+func (r *cachedNameResolver) get(cache map[uint32]*cachedName, id uint32, lookup func(id string) string) string {
+	r.lock.Lock()
+	cached, ok := cache[id]
+	if !ok {
+		cached = &cachedName{}
+		cache[id] = cached
+	}
+	r.lock.Unlock()
+	cached.once.Do(func() {
+		cached.name = lookup(strconv.FormatUint(uint64(id), 10))
+	})
+	return cached.name
+}
 
 // Stat stats a file and returns an Entry.
 func Stat(path string) (*Entry, error) {
@@ -138,29 +215,15 @@ func parseStat(name string, t *unix.Stat_t) *Entry {
 		size:    t.Size,
 		mode:    mode,
 		modTime: modTime,
+		ctime:   time.Unix(t.Ctim.Sec, t.Ctim.Nsec),
 		uid:     t.Uid,
 		gid:     t.Gid,
 		sys:     t,
-	}
-	// Parse owners.
-	var ok bool
-	if e.uname, ok = users[e.uid]; !ok {
-		u, _ := user.LookupId(strconv.Itoa(int(e.uid)))
-		if u != nil {
-			users[e.uid] = u.Username
-			e.uname = u.Username
-		} else {
-			users[e.uid] = ""
-		}
-	}
-	if e.gname, ok = groups[e.gid]; !ok {
-		g, _ := user.LookupGroupId(strconv.Itoa(int(e.gid)))
-		if g != nil {
-			groups[e.gid] = g.Name
-			e.gname = g.Name
-		} else {
-			groups[e.gid] = ""
-		}
+		dev:     uint64(t.Dev),
+		ino:     t.Ino,
+		nlink:   uint64(t.Nlink),
+		rdev:    uint64(t.Rdev),
+		names:   defaultNameResolver,
 	}
 	return e
 }
@@ -1,10 +1,14 @@
 package vaar
 
 import (
+	"archive/tar"
+	"bytes"
+	"fmt"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -59,6 +63,48 @@ func TestStatAt(t *testing.T) {
 	t.Run("test symlink", testStatSymlink(e, ts1, ts2))
 }
 
+// fakeNameResolver names the users and groups after their IDs.
+type fakeNameResolver struct{}
+
+func (fakeNameResolver) User(uid uint32) string {
+	return "user" + strconv.Itoa(int(uid))
+}
+
+func (fakeNameResolver) Group(gid uint32) string {
+	return "group" + strconv.Itoa(int(gid))
+}
+
+func TestNameResolver(t *testing.T) {
+	// The cache is safe for concurrent use.
+	r := NewCachedNameResolver()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, r.User(uint32(os.Getuid())), me.Username)
+			assert.Equal(t, r.Group(uint32(os.Getgid())), grp.Name)
+			assert.Equal(t, r.User(1<<31), "")
+		}()
+	}
+	wg.Wait()
+	tmpDir := createStatTestFiles(t)
+	expected := map[NameResolver]string{
+		fakeNameResolver{}: fmt.Sprintf("user%d:group%d", os.Getuid(), os.Getgid()),
+		NopNameResolver:    ":",
+	}
+	for resolver, owner := range expected {
+		var buf bytes.Buffer
+		c, err := NewComposer(&buf, WithNameResolver(resolver))
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(tmpDir.Join("file1"), ""))
+		assert.NilError(t, c.Close())
+		header, err := tar.NewReader(&buf).Next()
+		assert.NilError(t, err)
+		assert.Equal(t, header.Uname+":"+header.Gname, owner)
+	}
+}
+
 func createStatTestFiles(t *testing.T) *fs.Dir {
 	t.Helper()
 	tmpDir := fs.NewDir(
@@ -125,3 +171,21 @@ func testStatSymlink(e *Entry, ts1, ts2 time.Time) func(t *testing.T) {
 		assert.Assert(t, !ts1.Round(time.Second).After(modTime) && !ts2.Round(time.Second).Before(modTime))
 	}
 }
+
+func Test_cachedNameResolver(t *testing.T) {
+	r := NewCachedNameResolver().(*cachedNameResolver)
+	cache := make(map[uint32]*cachedName)
+	// A slow lookup of one ID doesn't block the others.
+	blocked, release := make(chan struct{}), make(chan struct{})
+	go r.get(cache, 1, func(string) string {
+		close(blocked)
+		<-release
+		return "slow"
+	})
+	<-blocked
+	assert.Equal(t, r.get(cache, 2, func(id string) string { return "fast" + id }), "fast2")
+	close(release)
+	// Each ID is looked up once.
+	assert.Equal(t, r.get(cache, 1, func(string) string { return "again" }), "slow")
+	assert.Equal(t, r.get(cache, 2, func(string) string { return "again" }), "fast2")
+}
@@ -1,12 +1,14 @@
 package vaar
 
 import (
-	"os"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+// errNoAttr is the error returned when an extended attribute doesn't exist.
+const errNoAttr = unix.ENOATTR
+
 // readAhead tells the kernel about reading a file in the near future, by issuing F_RDAHEAD and F_RDADVISE commands.
 func readAhead(fd, size int) error {
 	_, err := unix.FcntlInt(uintptr(fd), unix.F_RDAHEAD, 1)
@@ -25,7 +27,34 @@ func readAhead(fd, size int) error {
 	return err
 }
 
-// chmodSymlink changes the permission of a symlink at path.
-func chmodSymlink(path string, mode os.FileMode) error {
-	return unix.Fchmodat(unix.AT_FDCWD, path, uint32(mode), unix.AT_SYMLINK_NOFOLLOW)
+// chmodSymlink changes the permission of a symlink with the name in dirFd.
+func chmodSymlink(dirFd int, name string, mode uint32) error {
+	return unix.Fchmodat(dirFd, name, mode, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// mknodat creates a device file or a named pipe at path, as mknodat and mkfifoat are unavailable.
+// The parent directory has been opened by openBeneath, so path points to the same place unless it's replaced meanwhile.
+func mknodat(_ int, _, path string, mode uint32, dev int) error {
+	if mode&unix.S_IFMT == unix.S_IFIFO {
+		return unix.Mkfifo(path, mode&^unix.S_IFMT)
+	}
+	return unix.Mknod(path, mode, dev)
+}
+
+// openNoFollow opens the file with the name in dirFd without following a symlink,
+// so that the extended attributes of a symlink or a special file can be set with setXattrNoFollow.
+// O_NONBLOCK keeps named pipes from blocking the open.
+func openNoFollow(dirFd int, name string) (int, error) {
+	return unix.Openat(dirFd, name, unix.O_RDONLY|unix.O_SYMLINK|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+}
+
+// setXattrNoFollow sets an extended attribute of the file opened by openNoFollow.
+func setXattrNoFollow(fd int, attr string, data []byte) error {
+	return unix.Fsetxattr(fd, attr, data, 0)
+}
+
+// openBeneath opens the directory with the relative name in rootFd, without following any symlinks.
+// If create is true, missing directories are created. There's no openat2 on macOS, so the path is walked.
+func openBeneath(rootFd int, name string, create bool) (int, error) {
+	return walkBeneath(rootFd, name, create)
 }
@@ -1,17 +1,68 @@
 package vaar
 
 import (
-	"os"
+	"errors"
+	"strconv"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
 
+// errNoAttr is the error returned when an extended attribute doesn't exist.
+const errNoAttr = unix.ENODATA
+
 // readAhead tells the kernel about reading a file in the near future, by issuing a fadvise64 syscall.
 func readAhead(fd, size int) error {
 	return unix.Fadvise(fd, 0, int64(size), unix.FADV_SEQUENTIAL)
 }
 
 // chmodSymlink does nothing, as Linux doesn't support file modes of symlinks.
-func chmodSymlink(_ string, _ os.FileMode) error {
+func chmodSymlink(_ int, _ string, _ uint32) error {
 	return nil
 }
+
+// mknodat creates a device file or a named pipe with the name in dirFd. The path argument is unused.
+func mknodat(dirFd int, name, _ string, mode uint32, dev int) error {
+	return unix.Mknodat(dirFd, name, mode, dev)
+}
+
+// openNoFollow opens the file with the name in dirFd as a path without following a symlink,
+// so that the extended attributes of a symlink or a special file can be set with setXattrNoFollow.
+func openNoFollow(dirFd int, name string) (int, error) {
+	return unix.Openat(dirFd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// setXattrNoFollow sets an extended attribute of the file opened by openNoFollow.
+// fsetxattr doesn't accept O_PATH descriptors, so the file is reached by its magic link in /proc,
+// which refers to the opened file itself without following it again.
+func setXattrNoFollow(fd int, attr string, data []byte) error {
+	return unix.Setxattr("/proc/self/fd/"+strconv.Itoa(fd), attr, data, 0)
+}
+
+// openat2Unsupported is set if openat2 is unavailable, on kernels before 5.6 or blocked by seccomp.
+var openat2Unsupported int32
+
+// openBeneath opens the directory with the relative name in rootFd, without following any symlinks.
+// If create is true, missing directories are created.
+// The path is resolved by openat2 in one syscall if possible, and walkBeneath is the fallback.
+func openBeneath(rootFd int, name string, create bool) (int, error) {
+	if atomic.LoadInt32(&openat2Unsupported) == 0 {
+		fd, err := unix.Openat2(rootFd, name, &unix.OpenHow{
+			Flags:   unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+		})
+		switch {
+		case err == nil:
+			return fd, nil
+		case errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EPERM):
+			atomic.StoreInt32(&openat2Unsupported, 1)
+		case errors.Is(err, unix.ELOOP), errors.Is(err, unix.EXDEV):
+			return -1, errSymlinkComponent
+		case errors.Is(err, unix.ENOENT) && create:
+			// Walk to create the missing directories.
+		default:
+			return -1, err
+		}
+	}
+	return walkBeneath(rootFd, name, create)
+}
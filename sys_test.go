@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"golang.org/x/sys/unix"
 	"gotest.tools/v3/assert"
 	"gotest.tools/v3/fs"
 )
@@ -23,6 +24,9 @@ func Test_chmodSymlink(t *testing.T) {
 		fs.WithFile("test", "test"),
 		fs.WithSymlink("test_link", "test"),
 	)
-	err := chmodSymlink(tmpDir.Join("test_link"), 0o600)
+	dirFd, err := unix.Open(tmpDir.Path(), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	assert.NilError(t, err)
+	defer func() { _ = unix.Close(dirFd) }()
+	err = chmodSymlink(dirFd, "test_link", 0o600)
 	assert.NilError(t, err)
 }
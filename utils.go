@@ -1,13 +1,20 @@
 package vaar
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"path"
+	"runtime"
 	"strings"
-
-	"github.com/klauspost/compress/gzip"
-	"github.com/pierrec/lz4/v4"
 )
 
+// xzMagic is the magic number of xz, which is recognized but not supported unless registered.
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
 func validateRelPath(path string) error {
 	if len(path) == 0 {
 		return errors.New("empty path")
@@ -22,30 +29,85 @@ func validateRelPath(path string) error {
 	return nil
 }
 
-func getCompressionLevel(algorithm Algorithm, level Level) int64 {
-	switch algorithm {
-	case LZ4Algorithm:
-		switch level {
-		case FastestLevel, FastLevel, DefaultLevel:
-			return int64(lz4.Fast)
-		case GoodLevel:
-			return int64(lz4.Level5)
-		case BestLevel:
-			return int64(lz4.Level9)
+// stripComponents removes the first n components from a path in the tarball, like tar --strip-components.
+// An empty string is returned if the path doesn't have more than n components.
+func stripComponents(name string, n int) string {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	for ; n > 0; n-- {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return ""
 		}
-	case GzipAlgorithm:
-		switch level {
-		case FastestLevel:
-			return gzip.BestSpeed
-		case FastLevel:
-			return 3
-		case DefaultLevel:
-			return gzip.DefaultCompression
-		case GoodLevel:
-			return 7
-		case BestLevel:
-			return gzip.BestCompression
+		name = name[i+1:]
+	}
+	return name
+}
+
+// getConcurrency returns the number of threads used by compression algorithms. Zero means the number of CPUs.
+func getConcurrency(threads int) int {
+	if threads > 0 {
+		return threads
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// detectAlgorithm peeks the leading bytes of r to detect its compression algorithm.
+// It returns a reader to be used in place of r, which still yields the peeked bytes.
+// If r is seekable, it's returned as is after seeking back, so that seeking is still available to the callers.
+func detectAlgorithm(r io.Reader) (Algorithm, io.Reader, error) {
+	var magic []byte
+	if rs, ok := r.(io.ReadSeeker); ok && isSeekable(rs) {
+		magic = make([]byte, maxMagicSize())
+		n, err := io.ReadFull(rs, magic)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return NoAlgorithm, nil, fmt.Errorf("failed to read magic number: %w", err)
+		}
+		if _, err := rs.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return NoAlgorithm, nil, fmt.Errorf("failed to seek back after reading magic number: %w", err)
 		}
+		magic = magic[:n]
+	} else {
+		br := bufio.NewReader(r)
+		var err error
+		magic, err = br.Peek(maxMagicSize())
+		if err != nil && err != io.EOF {
+			return NoAlgorithm, nil, fmt.Errorf("failed to read magic number: %w", err)
+		}
+		r = br
+	}
+	if algorithm := matchMagic(magic); algorithm != NoAlgorithm {
+		return algorithm, r, nil
+	}
+	if bytes.HasPrefix(magic, xzMagic) {
+		return NoAlgorithm, nil, fmt.Errorf("%w: xz", ErrUnsupportedAlgorithm)
+	}
+	// Assume it's an uncompressed tarball. If not, the tar reader complains.
+	return NoAlgorithm, r, nil
+}
+
+// isSeekable reports whether a reader supports seeking, as some files like pipes implement io.Seeker but fail.
+func isSeekable(rs io.Seeker) bool {
+	_, err := rs.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// contextReader is a reader failing with the error of the context once it's done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// newContextReader wraps r to stop reading when ctx is done. If ctx is never done, r is returned as is.
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return 0
+	return r.r.Read(b)
 }
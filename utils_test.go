@@ -1,6 +1,8 @@
 package vaar
 
 import (
+	"bytes"
+	"io"
 	"testing"
 
 	"gotest.tools/v3/assert"
@@ -16,3 +18,50 @@ func Test_validateRelPath(t *testing.T) {
 	assert.NilError(t, validateRelPath("test/aaa"))
 	assert.NilError(t, validateRelPath("./test/././aaa"))
 }
+
+func Test_stripComponents(t *testing.T) {
+	assert.Equal(t, stripComponents("a/b/c", 0), "a/b/c")
+	assert.Equal(t, stripComponents("a/b/c", 1), "b/c")
+	assert.Equal(t, stripComponents("/a/b/c", 2), "c")
+	assert.Equal(t, stripComponents("./a//b/c/", 2), "c")
+	assert.Equal(t, stripComponents("a/b/c", 3), "")
+	assert.Equal(t, stripComponents("a", 1), "")
+}
+
+func Test_detectAlgorithm(t *testing.T) {
+	cases := []struct {
+		data      []byte
+		algorithm Algorithm
+	}{
+		{data: []byte{0x1f, 0x8b, 0x08, 0x00}, algorithm: GzipAlgorithm},
+		{data: []byte{0x04, 0x22, 0x4d, 0x18, 0x64}, algorithm: LZ4Algorithm},
+		{data: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x00, 0x00}, algorithm: ZstdAlgorithm},
+		{data: []byte("BZh91AY&SY\x00"), algorithm: Bzip2Algorithm},
+		{data: []byte("BZh9\x17\x72\x45\x38\x50\x90\x00\x00\x00\x00"), algorithm: Bzip2Algorithm},
+		// Names of files starting with "BZh" are not mistaken for bzip2.
+		{data: []byte("BZh91AY.txt\x00\x00"), algorithm: NoAlgorithm},
+		{data: []byte("BZhello\x00\x00\x00\x00"), algorithm: NoAlgorithm},
+		{data: []byte("file.txt\x00\x00"), algorithm: NoAlgorithm},
+		{data: []byte{}, algorithm: NoAlgorithm},
+	}
+	for _, c := range cases {
+		// A seekable reader is kept as is.
+		r := bytes.NewReader(c.data)
+		algorithm, dr, err := detectAlgorithm(r)
+		assert.NilError(t, err)
+		assert.Equal(t, algorithm, c.algorithm)
+		assert.Equal(t, dr, io.Reader(r))
+		data, err := io.ReadAll(dr)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, data, c.data)
+		// A non-seekable reader is wrapped.
+		algorithm, dr, err = detectAlgorithm(bytes.NewBuffer(c.data))
+		assert.NilError(t, err)
+		assert.Equal(t, algorithm, c.algorithm)
+		data, err = io.ReadAll(dr)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, data, c.data)
+	}
+	_, _, err := detectAlgorithm(bytes.NewReader([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}))
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+}
@@ -28,8 +28,15 @@ type WalkFunc func(path string, entry *Entry, r io.ReadCloser) error
 //   1. It takes WalkFunc instead of filepath.WalkFunc.
 //   2. The passed-in path must be a directory.
 //   3. The error that occurred during walking is directly returned, without passing to WalkFunc.
-//   4. Lots of magic targeting *nix systems. See the comments for details.
+//   4. If WalkFunc returns filepath.SkipDir on a directory, the directory is not walked into.
+//      Returned on other files, it's ignored and the walking continues.
+//   5. Lots of magic targeting *nix systems. See the comments for details.
 func Walk(path string, walkFunc WalkFunc) error {
+	return walkPath(path, false, walkFunc)
+}
+
+// walkPath is Walk, optionally passing the entries of each directory sorted by their names instead of inodes.
+func walkPath(path string, byName bool, walkFunc WalkFunc) error {
 	// Memory allocations are expensive. Use a pool to reuse buffers.
 	dentBufPool := &sync.Pool{
 		New: func() interface{} {
@@ -52,19 +59,25 @@ func Walk(path string, walkFunc WalkFunc) error {
 		return fmt.Errorf("failed to stat the walk path: %w", err)
 	}
 	if err := walkFunc(path, parseStat(filepath.Base(path), &stat), nil); err != nil {
+		_ = unix.Close(dirFd)
+		if err == filepath.SkipDir {
+			return nil
+		}
 		return err
 	}
-	return walk(path, dirFd, dentBufPool, walkFunc)
+	return walk(path, dirFd, dentBufPool, byName, walkFunc)
 }
 
 // walk does the real walking stuff. It receives an opened directory and iterates the items in it.
-func walk(dirName string, dirFd int, dentBufPool *sync.Pool, walkFunc WalkFunc) error {
+// If byName is set, all entries are read before walking, so that they can be sorted by their names.
+func walk(dirName string, dirFd int, dentBufPool *sync.Pool, byName bool, walkFunc WalkFunc) error {
 	buf := dentBufPool.Get().([]byte)
 	defer func() {
 		// The directory is closed when this function ends, and the dent buffer is returned to the pool.
 		_ = unix.Close(dirFd)
 		dentBufPool.Put(buf)
 	}()
+	var sorted []*dirent
 	for {
 		// Use a large buffer to get directory entries.
 		// The buffer size in os.ReadDir is 8 KiB and is too small, causing many unnecessary syscall operations.
@@ -73,46 +86,66 @@ func walk(dirName string, dirFd int, dentBufPool *sync.Pool, walkFunc WalkFunc)
 			return fmt.Errorf("failed to call getdents64 on %s: %w", dirName, err)
 		}
 		if n == 0 {
-			return nil
+			break
 		}
 		dirents := parseDirentBuf(buf[:n])
-		for _, dent := range dirents {
-			var reader io.ReadCloser
-			if dent.typ == unix.DT_REG {
-				// A regular file should be opened for reading.
-				// Also, use openat with the already opened parent directory to save time.
-				fd, err := unix.Openat(dirFd, dent.name, os.O_RDONLY, 0)
-				if err != nil {
-					return fmt.Errorf("failed to open %s for reading: %w", filepath.Join(dirName, dent.name), err)
-				}
-				reader = os.NewFile(uintptr(fd), dent.name)
-				// Issue a read ahead instruction to the kernel to prefetch the file content.
-				_ = readAhead(fd, adviceSize)
+		if byName {
+			sorted = append(sorted, dirents...)
+			continue
+		}
+		if err := walkDirents(dirName, dirFd, dirents, dentBufPool, byName, walkFunc); err != nil {
+			return err
+		}
+	}
+	if byName {
+		sortDirentsByName(sorted)
+		return walkDirents(dirName, dirFd, sorted, dentBufPool, byName, walkFunc)
+	}
+	return nil
+}
+
+// walkDirents passes the entries in an opened directory to walkFunc, and walks into the sub-directories.
+func walkDirents(dirName string, dirFd int, dirents []*dirent, dentBufPool *sync.Pool, byName bool, walkFunc WalkFunc) error {
+	for _, dent := range dirents {
+		var reader io.ReadCloser
+		if dent.typ == unix.DT_REG {
+			// A regular file should be opened for reading.
+			// Also, use openat with the already opened parent directory to save time.
+			fd, err := unix.Openat(dirFd, dent.name, os.O_RDONLY, 0)
+			if err != nil {
+				return fmt.Errorf("failed to open %s for reading: %w", filepath.Join(dirName, dent.name), err)
+			}
+			reader = os.NewFile(uintptr(fd), dent.name)
+			// Issue a read ahead instruction to the kernel to prefetch the file content.
+			_ = readAhead(fd, adviceSize)
+		}
+		// Use fstatat with the fd of the already opened parent directory to save time.
+		// If we use the full path directly, the kernel has to walk through the full path and do heavy checks
+		// like the permission.
+		entry, err := StatAt(dirFd, dent.name)
+		if err != nil {
+			return err
+		}
+		filePath := filepath.Join(dirName, dent.name)
+		if err := walkFunc(filePath, entry, reader); err != nil {
+			if err == filepath.SkipDir {
+				continue
 			}
-			// Use fstatat with the fd of the already opened parent directory to save time.
-			// If we use the full path directly, the kernel has to walk through the full path and do heavy checks
-			// like the permission.
-			entry, err := StatAt(dirFd, dent.name)
+			return err
+		}
+		if entry.IsDir() {
+			// Walk the sub-directories recursively.
+			// Also, use openat with the already opened parent directory to save time.
+			nextDirFd, err := unix.Openat(dirFd, dent.name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to open directory %s in %s: %w", dent.name, dirName, err)
 			}
-			filePath := filepath.Join(dirName, dent.name)
-			if err := walkFunc(filePath, entry, reader); err != nil {
+			if err := walk(filePath, nextDirFd, dentBufPool, byName, walkFunc); err != nil {
 				return err
 			}
-			if entry.IsDir() {
-				// Walk the sub-directories recursively.
-				// Also, use openat with the already opened parent directory to save time.
-				nextDirFd, err := unix.Openat(dirFd, dent.name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
-				if err != nil {
-					return fmt.Errorf("failed to open directory %s in %s: %w", dent.name, dirName, err)
-				}
-				if err := walk(filePath, nextDirFd, dentBufPool, walkFunc); err != nil {
-					return err
-				}
-			}
 		}
 	}
+	return nil
 }
 
 // parseDirentBuf parses the dir entries returned by the syscall.
@@ -150,6 +183,14 @@ func parseDirentBuf(buf []byte) []*dirent {
 	return dirents
 }
 
+// sortDirentsByName sorts the dir entries by their names, in byte order.
+// It gives the same order on any filesystem, at the cost of the read performance.
+func sortDirentsByName(dirents []*dirent) {
+	sort.Slice(dirents, func(i, j int) bool {
+		return dirents[i].name < dirents[j].name
+	})
+}
+
 // getDirentName returns the name field of a unix.Dirent.
 func getDirentName(dirent *unix.Dirent) string {
 	name := make([]byte, len(dirent.Name))
@@ -0,0 +1,108 @@
+package vaar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParallelWalk(t *testing.T) {
+	root := makeTree(t, t.TempDir(), 2, 4, 300)
+	assert.NilError(t, os.Symlink("0", filepath.Join(root, "link")))
+	walkNames := func(walk func(WalkFunc) error, skip string) []string {
+		var names []string
+		err := walk(func(path string, entry *Entry, r io.ReadCloser) error {
+			names = append(names, path)
+			if r != nil {
+				assert.Assert(t, entry.Mode().IsRegular())
+				content, err := io.ReadAll(r)
+				assert.NilError(t, err)
+				assert.Equal(t, string(content), filepath.Base(path))
+				assert.NilError(t, r.Close())
+			}
+			if filepath.Base(path) == skip {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		assert.NilError(t, err)
+		return names
+	}
+	for _, skip := range []string{"", "1"} {
+		expected := walkNames(func(walkFunc WalkFunc) error { return Walk(root, walkFunc) }, skip)
+		for _, threads := range []int{1, 4, 16} {
+			names := walkNames(func(walkFunc WalkFunc) error { return ParallelWalk(root, threads, walkFunc) }, skip)
+			assert.DeepEqual(t, names, expected)
+		}
+	}
+	// Errors stop the walking.
+	count := 0
+	err := ParallelWalk(root, 4, func(path string, entry *Entry, r io.ReadCloser) error {
+		if r != nil {
+			_ = r.Close()
+		}
+		if count++; count == 100 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, count, 100)
+	// Tarballs are the same, no matter how many threads are used.
+	var tarballs [2]bytes.Buffer
+	for i, threads := range []int{1, 8} {
+		c, err := NewComposer(&tarballs[i], WithThread(threads))
+		assert.NilError(t, err)
+		assert.NilError(t, c.Add(root, ""))
+		assert.NilError(t, c.Close())
+	}
+	assert.Assert(t, bytes.Equal(tarballs[0].Bytes(), tarballs[1].Bytes()))
+}
+
+func BenchmarkWalk(b *testing.B) {
+	root := makeTree(b, b.TempDir(), 3, 8, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assert.NilError(b, Walk(root, discardWalkFunc))
+	}
+}
+
+func BenchmarkParallelWalk(b *testing.B) {
+	root := makeTree(b, b.TempDir(), 3, 8, 100)
+	for _, threads := range []int{2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("%d", threads), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				assert.NilError(b, ParallelWalk(root, threads, discardWalkFunc))
+			}
+		})
+	}
+}
+
+// makeTree creates a directory tree with the depth, where each directory has the number of sub-directories and files.
+// The content of each file is its name. It returns the path of the tree.
+func makeTree(t testing.TB, path string, depth, dirs, files int) string {
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("file%d", i)
+		assert.NilError(t, os.WriteFile(filepath.Join(path, name), []byte(name), 0o644))
+	}
+	if depth > 0 {
+		for i := 0; i < dirs; i++ {
+			subPath := filepath.Join(path, fmt.Sprintf("%d", i))
+			assert.NilError(t, os.Mkdir(subPath, 0o755))
+			makeTree(t, subPath, depth-1, dirs, files)
+		}
+	}
+	return path
+}
+
+func discardWalkFunc(_ string, _ *Entry, r io.ReadCloser) error {
+	if r != nil {
+		_ = r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package vaar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxXattrPrefix is the prefix of PAX records storing extended attributes, the same as GNU tar and star.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// readXattrs reads all extended attributes with list and get, which are either fd-based or path-based.
+// If the filesystem doesn't support extended attributes, nothing is returned.
+func readXattrs(
+	list func(dest []byte) (int, error),
+	get func(attr string, dest []byte) (int, error),
+) (map[string]string, error) {
+	names, err := readXattrValue(list)
+	if err != nil {
+		if isXattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+	var xattrs map[string]string
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := readXattrValue(func(dest []byte) (int, error) { return get(name, dest) })
+		if err != nil {
+			if errors.Is(err, errNoAttr) {
+				// The attribute is removed after listing.
+				continue
+			}
+			return nil, fmt.Errorf("failed to get extended attribute %s: %w", name, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+// readXattrValue calls a xattr syscall to get the size first, and then the content.
+func readXattrValue(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if err == unix.ERANGE {
+			// The value grows after we get the size. Try again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// readFileXattrs reads the extended attributes of an opened file.
+func readFileXattrs(fd int) (map[string]string, error) {
+	return readXattrs(
+		func(dest []byte) (int, error) { return unix.Flistxattr(fd, dest) },
+		func(attr string, dest []byte) (int, error) { return unix.Fgetxattr(fd, attr, dest) },
+	)
+}
+
+// readPathXattrs reads the extended attributes of a file at path, without following symlinks.
+func readPathXattrs(path string) (map[string]string, error) {
+	return readXattrs(
+		func(dest []byte) (int, error) { return unix.Llistxattr(path, dest) },
+		func(attr string, dest []byte) (int, error) { return unix.Lgetxattr(path, attr, dest) },
+	)
+}
+
+// setHeaderXattrs stores extended attributes in the PAX records of a header.
+func setHeaderXattrs(header *tar.Header, xattrs map[string]string) {
+	if len(xattrs) == 0 {
+		return
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string, len(xattrs))
+	}
+	for name, value := range xattrs {
+		header.PAXRecords[paxXattrPrefix+name] = value
+	}
+}
+
+// hasXattrs reports whether any extended attribute is stored in the PAX records of a header.
+func hasXattrs(header *tar.Header) bool {
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreXattrs sets the extended attributes stored in the PAX records of a header with set.
+// Errors caused by lack of support or permission are ignored, like restoring the owners.
+func restoreXattrs(header *tar.Header, set func(attr string, data []byte) error) error {
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := set(name, []byte(value)); err != nil {
+			if isXattrUnsupported(err) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+				continue
+			}
+			return fmt.Errorf("failed to set extended attribute %s of %s: %w", name, header.Name, err)
+		}
+	}
+	return nil
+}
+
+// isXattrUnsupported reports whether an error means the filesystem doesn't support extended attributes.
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}